@@ -0,0 +1,38 @@
+// Command packetgen writes the JSON Schema and the TypeScript definitions
+// of the lobby packets, as registered in the codeduel package.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/xedom/codeduel-lobby/codeduel"
+)
+
+func main() {
+	out := flag.String("out", "schema", "directory of the generated files")
+	flag.Parse()
+
+	if err := os.MkdirAll(*out, 0o755); err != nil {
+		log.Fatal(err)
+	}
+	writeSchema(filepath.Join(*out, "inbound.schema.json"), codeduel.InboundPackets)
+	writeSchema(filepath.Join(*out, "outbound.schema.json"), codeduel.OutboundPackets)
+	typeScript := codeduel.TypeScript(codeduel.InboundPackets, codeduel.OutboundPackets)
+	if err := os.WriteFile(filepath.Join(*out, "packets.d.ts"), []byte(typeScript), 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func writeSchema(path string, registry *codeduel.PacketRegistry) {
+	schema, err := json.MarshalIndent(registry.Schema(), "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(path, append(schema, '\n'), 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
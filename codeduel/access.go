@@ -0,0 +1,162 @@
+package codeduel
+
+import (
+	"bytes"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// bcrypt ignores anything past the first 72 bytes
+	maxPasswordSize = 72
+	// joinTicketLifetime is how long a user has to join after giving the password
+	joinTicketLifetime = 30 * time.Second
+)
+
+// lobbyAccess decides who can join the lobby besides its members. The hash
+// of the password never leaves the server, clients only see the flags.
+type lobbyAccess struct {
+	locked       bool
+	passwordHash []byte
+	inviteOnly   bool
+	invited      []UserId
+	tickets      map[string]joinTicket
+}
+
+// joinTicket proves that a user gave the password of the lobby, so that the
+// password is not part of the websocket URL. It is redeemed once.
+type joinTicket struct {
+	user         UserId
+	passwordHash []byte
+	expires      time.Time
+}
+
+// LobbyAccess is the part of lobbyAccess shown to the members of the lobby.
+type LobbyAccess struct {
+	Locked      bool     `json:"locked"`
+	HasPassword bool     `json:"hasPassword"`
+	InviteOnly  bool     `json:"inviteOnly"`
+	Invited     []UserId `json:"invited"`
+}
+
+func (access lobbyAccess) public() LobbyAccess {
+	invited := access.invited
+	if invited == nil {
+		invited = []UserId{}
+	}
+	return LobbyAccess{
+		Locked:      access.locked,
+		HasPassword: access.passwordHash != nil,
+		InviteOnly:  access.inviteOnly,
+		Invited:     invited,
+	}
+}
+
+// hashPassword hashes the password of the lobby, an empty password removes
+// it. It is slow on purpose, so it runs outside the lobby goroutine.
+func hashPassword(password string) ([]byte, error) {
+	if password == "" {
+		return nil, nil
+	}
+	if len(password) > maxPasswordSize {
+		return nil, NewLobbyError(ErrorInvalidValue, "password must be at most %d bytes", maxPasswordSize)
+	}
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+// PasswordHash returns the hash of the password of the lobby, nil if it has
+// none.
+func (lobby *Lobby) PasswordHash() []byte {
+	return lobby.access.passwordHash
+}
+
+// verifyPassword returns the hash the password matches, to be passed to
+// CannotJoin, or nil if it does not match. Like hashPassword it is slow.
+func verifyPassword(passwordHash []byte, password string) []byte {
+	if passwordHash == nil || bcrypt.CompareHashAndPassword(passwordHash, []byte(password)) != nil {
+		return nil
+	}
+	return passwordHash
+}
+
+// IssueTicket stores a ticket for the user with the hash the password given
+// by the user matched, and returns its id.
+func (lobby *Lobby) IssueTicket(user *User, verifiedHash []byte) string {
+	now := time.Now()
+	if lobby.access.tickets == nil {
+		lobby.access.tickets = map[string]joinTicket{}
+	}
+	maps.DeleteFunc(lobby.access.tickets, func(_ string, ticket joinTicket) bool {
+		return !now.Before(ticket.expires)
+	})
+	id := uuid.NewString()
+	lobby.access.tickets[id] = joinTicket{
+		user:         user.Id,
+		passwordHash: verifiedHash,
+		expires:      now.Add(joinTicketLifetime),
+	}
+	return id
+}
+
+// redeemTicket returns the hash verified by the ticket of the user, to be
+// passed to CannotJoin, or nil if the ticket is unknown or expired.
+func (lobby *Lobby) redeemTicket(user *User, id string) []byte {
+	ticket, ok := lobby.access.tickets[id]
+	if !ok || ticket.user != user.Id {
+		return nil
+	}
+	delete(lobby.access.tickets, id)
+	if !time.Now().Before(ticket.expires) {
+		return nil
+	}
+	return ticket.passwordHash
+}
+
+// checkAccess rejects users that are not members when the lobby is locked,
+// invite-only or protected by a password. verifiedHash is the hash the
+// password given by the user matched, it must still be the current one.
+func (lobby *Lobby) checkAccess(user *User, verifiedHash []byte) error {
+	access := lobby.access
+	if access.locked {
+		return NewLobbyError(ErrorLobbyLocked, "lobby is locked")
+	}
+	if access.inviteOnly && !slices.Contains(access.invited, user.Id) {
+		return NewLobbyError(ErrorNotInvited, "lobby is invite-only")
+	}
+	if access.passwordHash != nil && !bytes.Equal(access.passwordHash, verifiedHash) {
+		return NewLobbyError(ErrorWrongPassword, "wrong password")
+	}
+	return nil
+}
+
+// SetLocked locks or unlocks the lobby.
+func (lobby *Lobby) SetLocked(locked bool) {
+	lobby.access.locked = locked
+	lobby.broadcastAccess()
+}
+
+// SetPasswordHash replaces the password of the lobby, nil removes it.
+func (lobby *Lobby) SetPasswordHash(passwordHash []byte) {
+	lobby.access.passwordHash = passwordHash
+	lobby.broadcastAccess()
+}
+
+// SetInvites switches the lobby to or from invite-only with the users
+// allowed to join.
+func (lobby *Lobby) SetInvites(inviteOnly bool, invited []UserId) {
+	lobby.access.inviteOnly = inviteOnly
+	invited = slices.Clone(invited)
+	slices.Sort(invited)
+	lobby.access.invited = slices.Compact(invited)
+	lobby.broadcastAccess()
+}
+
+func (lobby *Lobby) broadcastAccess() {
+	lobby.BroadcastPacket(PacketOutAccessUpdated{
+		Access: lobby.access.public(),
+	})
+}
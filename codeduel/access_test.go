@@ -0,0 +1,113 @@
+package codeduel
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// rejection dials the lobby and returns why the connection was closed.
+func rejection(t *testing.T, server *httptest.Server, path string, token string) string {
+	t.Helper()
+	return dialLobby(t, server, path, token).closeReason()
+}
+
+func issueTicket(t *testing.T, server *httptest.Server, id string, token string, password string) (int, string) {
+	t.Helper()
+	request, err := http.NewRequest("POST", server.URL+"/lobbies/"+id+"/tickets", strings.NewReader(`{"password":"`+password+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Add("Cookie", "access_token="+token)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var body map[string]string
+	_ = json.NewDecoder(response.Body).Decode(&body)
+	return response.StatusCode, body["ticket"]
+}
+
+func TestLobbyAccess(t *testing.T) {
+	_, server := newTestServer(t)
+	owner := dialLobby(t, server, "/create", "u1")
+	lobby := owner.until("lobby")
+	id := lobby["id"].(string)
+	if access := lobby["access"].(map[string]any); access["locked"] != false || access["hasPassword"] != false {
+		t.Fatal(access)
+	}
+	player := joinLobby(t, server, id, "u2")
+	for _, packet := range []map[string]any{
+		{"type": "lock", "lock": true},
+		{"type": "setPassword", "password": "x"},
+	} {
+		player.send(packet)
+		if err := player.until("error"); err["code"] != "not_owner" {
+			t.Fatal(err)
+		}
+	}
+
+	owner.send(map[string]any{"type": "lock", "lock": true})
+	owner.until("accessUpdated")
+	if reason := rejection(t, server, "/join/"+id, "u3"); !strings.HasPrefix(reason, "4423 ") {
+		t.Fatal(reason)
+	}
+	// members can still come back
+	joinLobby(t, server, id, "u2")
+
+	owner.send(map[string]any{"type": "lock", "lock": false})
+	owner.send(map[string]any{"type": "setPassword", "password": "secret"})
+	// skip the update unlocking the lobby
+	for owner.until("accessUpdated")["access"].(map[string]any)["hasPassword"] != true {
+	}
+	response, err := http.Get(server.URL + "/lobbies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	_ = response.Body.Close()
+	if !strings.Contains(string(body), `"has_password":true`) || strings.Contains(string(body), "secret") {
+		t.Fatal(string(body))
+	}
+	if reason := rejection(t, server, "/join/"+id, "u3"); reason != "4430 wrong password" {
+		t.Fatal(reason)
+	}
+	if status, _ := issueTicket(t, server, id, "u3", "nope"); status != http.StatusForbidden {
+		t.Fatal(status)
+	}
+	// tickets belong to the user they were issued to
+	_, other := issueTicket(t, server, id, "u4", "secret")
+	if reason := rejection(t, server, "/join/"+id+"?ticket="+other, "u3"); reason != "4430 wrong password" {
+		t.Fatal(reason)
+	}
+	_, ticket := issueTicket(t, server, id, "u3", "secret")
+	joinLobby(t, server, id+"?ticket="+ticket, "u3")
+	if reason := rejection(t, server, "/join/"+id+"?ticket="+ticket, "u4"); reason != "4430 wrong password" {
+		t.Fatal(reason)
+	}
+
+	owner.send(map[string]any{"type": "setPassword", "password": ""})
+	owner.send(map[string]any{"type": "setInvites", "inviteOnly": true, "userIds": []int{5, 5}})
+	access := owner.until("accessUpdated")["access"].(map[string]any)
+	for access["inviteOnly"] != true {
+		access = owner.until("accessUpdated")["access"].(map[string]any)
+	}
+	if len(access["invited"].([]any)) != 1 {
+		t.Fatal(access)
+	}
+	if reason := rejection(t, server, "/join/"+id, "u4"); !strings.HasPrefix(reason, "4431 ") {
+		t.Fatal(reason)
+	}
+	joinLobby(t, server, id, "u5")
+
+	owner.send(map[string]any{"type": "setInvites", "inviteOnly": false})
+	owner.send(map[string]any{"type": "updateSettings", "settings": map[string]any{"maxPlayers": 4, "gameDuration": 60, "allowedLanguages": []string{"go"}}})
+	owner.until("settingsUpdated")
+	if reason := rejection(t, server, "/join/"+id, "u6"); !strings.HasPrefix(reason, "4429 ") {
+		t.Fatal(reason)
+	}
+}
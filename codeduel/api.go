@@ -1,11 +1,16 @@
 package codeduel
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/handlers"
@@ -16,10 +21,18 @@ import (
 type APIServer struct {
 	Config            *utils.Config
 	Addr              string
-	Lobbies           map[string]*Lobby
+	Lobbies           *LobbyRegistry
 	ReadHeaderTimeout time.Duration
 	Runner            *Runner
 	Backend           *Backend
+
+	draining atomic.Bool
+	// starting guards draining against games.Add, so that no game starts
+	// once Shutdown has taken its snapshot of the lobbies
+	starting      sync.Mutex
+	games         sync.WaitGroup
+	closing       context.Context
+	cancelClosing context.CancelFunc
 }
 
 type VerifyTokenResponse struct {
@@ -30,9 +43,10 @@ type VerifyTokenResponse struct {
 	BackgroundImage string `json:"backgroundImage"`
 }
 
-func NewApiServer(config *utils.Config, lobbies map[string]*Lobby, runner *Runner, backend *Backend) *APIServer {
+func NewApiServer(config *utils.Config, lobbies *LobbyRegistry, runner *Runner, backend *Backend) *APIServer {
 	address := fmt.Sprintf("%s:%s", config.Host, config.Port)
 	log.Print("[API] Starting API server on http://", address)
+	closing, cancelClosing := context.WithCancel(context.Background())
 	return &APIServer{
 		Config:            config,
 		Addr:              address,
@@ -40,10 +54,13 @@ func NewApiServer(config *utils.Config, lobbies map[string]*Lobby, runner *Runne
 		ReadHeaderTimeout: 3 * time.Second,
 		Runner:            runner,
 		Backend:           backend,
+		closing:           closing,
+		cancelClosing:     cancelClosing,
 	}
 }
 
-func (s *APIServer) Run() {
+// Router returns the routes of the server.
+func (s *APIServer) Router() *mux.Router {
 	router := mux.NewRouter()
 
 	router.HandleFunc("/health", s.healthCheck)
@@ -51,17 +68,38 @@ func (s *APIServer) Run() {
 	router.HandleFunc("/lobbies", s.getAllLobbies)
 	router.HandleFunc("/join/{lobby}", s.joinLobby)
 	router.HandleFunc("/connect/{lobby}", s.connectLobby)
+	router.HandleFunc("/lobbies/{lobby}/tickets", s.createTicket).Methods(http.MethodPost)
+	router.HandleFunc("/lobbies/{lobby}/submissions", s.uploadSubmission).Methods(http.MethodPost)
+	return router
+}
 
-	err := http.ListenAndServe(s.Addr, handlers.CORS(
-		handlers.AllowedOrigins([]string{s.Config.CorsOrigin}),
-		handlers.AllowedMethods([]string{s.Config.CorsMethods}),
-		handlers.AllowedHeaders([]string{s.Config.CorsHeaders}),
-		handlers.AllowCredentials(),
-	)(router))
+func (s *APIServer) Run() {
+	router := s.Router()
 
-	if err != nil {
-		log.Fatal("[API] Cannot start http server: ", err)
+	server := &http.Server{
+		Addr:              s.Addr,
+		ReadHeaderTimeout: s.ReadHeaderTimeout,
+		Handler: handlers.CORS(
+			handlers.AllowedOrigins([]string{s.Config.CorsOrigin}),
+			handlers.AllowedMethods([]string{s.Config.CorsMethods}),
+			handlers.AllowedHeaders([]string{s.Config.CorsHeaders}),
+			handlers.AllowCredentials(),
+		)(router),
 	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("[API] Cannot start http server: ", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	log.Print("[API] Shutting down API server")
+	s.Shutdown(server, s.Config.ShutdownTimeout)
 }
 
 func (s *APIServer) healthCheck(response http.ResponseWriter, request *http.Request) {
@@ -71,6 +109,14 @@ func (s *APIServer) healthCheck(response http.ResponseWriter, request *http.Requ
 }
 
 func (s *APIServer) createLobby(response http.ResponseWriter, request *http.Request) {
+	handshake, ok := s.negotiate(response, request)
+	if !ok {
+		return
+	}
+	if s.draining.Load() {
+		_ = RejectConnection(response, request, ServiceRestart, "server shutting down")
+		return
+	}
 	user, err := s.GetUser(request)
 	if err != nil {
 		log.Printf("[API] error getting user: %v", err)
@@ -83,83 +129,188 @@ func (s *APIServer) createLobby(response http.ResponseWriter, request *http.Requ
 		_ = RejectConnection(response, request, InternalServerError, "cannot contact runner")
 		return
 	}
-	lobby := NewLobby(user, languages)
-	s.Lobbies[lobby.Id] = &lobby
-	_, err = s.StartWebSocket(response, request, &lobby, user)
+	lobby := NewLobby(user, languages, s.Config.RunnerTimings, s.Config.MaxCodeSize)
+	_ = lobby.Do(func() { s.Lobbies.Add(lobby) })
+	_, err = s.StartWebSocket(response, request, lobby, user, handshake)
 	if err != nil {
 		log.Printf("[API] error starting websocket: %v", err)
+		// nobody else knows the lobby yet
+		s.Lobbies.Remove(lobby.Id)
+		_ = lobby.Post(lobby.Close)
 		_ = RejectConnection(response, request, InternalServerError, "cannot start websocket connection")
 		return
 	}
 }
 
 func (s *APIServer) joinLobby(response http.ResponseWriter, request *http.Request) {
+	handshake, ok := s.negotiate(response, request)
+	if !ok {
+		return
+	}
+	if s.draining.Load() {
+		_ = RejectConnection(response, request, ServiceRestart, "server shutting down")
+		return
+	}
 	user, err := s.GetUser(request)
 	if err != nil {
 		_ = RejectConnection(response, request, Unauthorized, err.Error())
 		return
 	}
 	lobbyId := mux.Vars(request)["lobby"]
-	lobby, ok := s.Lobbies[lobbyId]
+	lobby, ok := s.Lobbies.Get(lobbyId)
 	if !ok {
 		response.WriteHeader(http.StatusNotFound)
 		return
 	}
-	if err := lobby.CannotJoin(user); err != nil {
-		response.WriteHeader(http.StatusForbidden)
+	// the password was given for a ticket, see createTicket
+	ticket := request.URL.Query().Get("ticket")
+	joined := false
+	err = lobby.Call(func() error {
+		if err := lobby.CannotJoin(user, lobby.redeemTicket(user, ticket)); err != nil {
+			return err
+		}
+		if member := lobby.GetUser(user); member != nil {
+			user = member
+		} else {
+			lobby.AddUser(user)
+			joined = true
+		}
+		return nil
+	})
+	if err != nil {
+		_ = RejectConnection(response, request, joinCloseCodeOf(ErrorCodeOf(err)), err.Error())
 		return
 	}
-	if isUserInLobby := lobby.GetUser(user); isUserInLobby == nil {
-		lobby.AddUser(user)
-	}
-	_, err = s.StartWebSocket(response, request, lobby, user)
+	_, err = s.StartWebSocket(response, request, lobby, user, handshake)
 	if err != nil {
+		if joined {
+			// the seat taken above must not stay without a connection
+			_ = lobby.Do(func() {
+				if state, ok := lobby.State.(*PreLobbyState); ok && lobby.Users[user.Id] == user && user.Connection == nil {
+					lobby.removeUser(state, user)
+				}
+			})
+		}
 		_ = RejectConnection(response, request, InternalServerError, "cannot start websocket connection")
 		return
 	}
 }
 
+// ticketRequest is the body of a join ticket request.
+type ticketRequest struct {
+	Password string `json:"password"`
+}
+
+// createTicket checks the password of a lobby and returns a short-lived
+// ticket, passed to joinLobby in place of the password.
+func (s *APIServer) createTicket(response http.ResponseWriter, request *http.Request) {
+	user, err := s.GetUser(request)
+	if err != nil {
+		writeHttpError(response, http.StatusUnauthorized, PacketOutError{Code: ErrorNotAuthorized, Message: err.Error()})
+		return
+	}
+	lobby, ok := s.Lobbies.Get(mux.Vars(request)["lobby"])
+	if !ok {
+		writeHttpError(response, http.StatusNotFound, PacketOutError{Code: ErrorLobbyNotFound, Message: "lobby not found"})
+		return
+	}
+	var body ticketRequest
+	if err := json.NewDecoder(http.MaxBytesReader(response, request.Body, maxMessageSize)).Decode(&body); err != nil {
+		writeHttpError(response, http.StatusBadRequest, PacketOutError{Code: ErrorMalformedPacket, Message: err.Error()})
+		return
+	}
+	// the password is compared outside the lobby goroutine, bcrypt is slow
+	var passwordHash []byte
+	if err := lobby.Read(func() { passwordHash = lobby.PasswordHash() }); err != nil {
+		writeHttpError(response, http.StatusNotFound, PacketOutError{Code: ErrorLobbyNotFound, Message: "lobby not found"})
+		return
+	}
+	verifiedHash := verifyPassword(passwordHash, body.Password)
+	if passwordHash != nil && verifiedHash == nil {
+		writeHttpError(response, http.StatusForbidden, PacketOutError{Code: ErrorWrongPassword, Message: "wrong password"})
+		return
+	}
+	var ticket string
+	if err := lobby.Read(func() { ticket = lobby.IssueTicket(user, verifiedHash) }); err != nil {
+		writeHttpError(response, http.StatusNotFound, PacketOutError{Code: ErrorLobbyNotFound, Message: "lobby not found"})
+		return
+	}
+	response.Header().Add("Content-Type", "application/json")
+	_ = json.NewEncoder(response).Encode(map[string]string{"ticket": ticket})
+}
+
 func (s *APIServer) connectLobby(response http.ResponseWriter, request *http.Request) {
+	handshake, ok := s.negotiate(response, request)
+	if !ok {
+		return
+	}
+	if s.draining.Load() {
+		_ = RejectConnection(response, request, ServiceRestart, "server shutting down")
+		return
+	}
 	user, err := s.GetUser(request)
 	if err != nil {
 		_ = RejectConnection(response, request, Unauthorized, err.Error())
 		return
 	}
 	lobbyId := mux.Vars(request)["lobby"]
-	lobby, ok := s.Lobbies[lobbyId]
+	lobby, ok := s.Lobbies.Get(lobbyId)
 	if !ok {
 		_ = RejectConnection(response, request, NotFound, "lobby not found")
 		return
 	}
-	if user := lobby.GetUser(user); user == nil {
+	var member *User
+	if err := lobby.Read(func() { member = lobby.GetUser(user) }); err != nil {
+		_ = RejectConnection(response, request, NotFound, "lobby not found")
+		return
+	}
+	if member == nil {
 		_ = RejectConnection(response, request, Forbidden, "user not in lobby")
 		return
 	}
-	_, err = s.StartWebSocket(response, request, lobby, user)
+	user = member
+	_, err = s.StartWebSocket(response, request, lobby, user, handshake)
 	if err != nil {
 		_ = RejectConnection(response, request, InternalServerError, "cannot start websocket connection")
 		return
 	}
 }
 
-func (s *APIServer) getAllLobbies(response http.ResponseWriter, _ *http.Request) {
+func (s *APIServer) getAllLobbies(response http.ResponseWriter, request *http.Request) {
 	type lobbyListType struct {
-		Id         string `json:"id"`
-		Owner      *User  `json:"owner"`
-		Users      int    `json:"users"`
-		MaxPlayers int    `json:"max_players"`
-		State      any    `json:"state"`
-	}
-
-	lobbyList := make([]lobbyListType, 0, len(s.Lobbies))
-
-	for key, lobby := range s.Lobbies {
-		lobbyList = append(lobbyList, lobbyListType{
-			Id:         key,
-			Owner:      lobby.Owner,
-			Users:      len(lobby.Users),
-			MaxPlayers: lobby.Settings.MaxPlayers,
-			State:      GetStateType(lobby.State),
+		Id          string `json:"id"`
+		Owner       *User  `json:"owner"`
+		Users       int    `json:"users"`
+		MaxPlayers  int    `json:"max_players"`
+		State       any    `json:"state"`
+		Mode        string `json:"mode"`
+		Locked      bool   `json:"locked"`
+		HasPassword bool   `json:"has_password"`
+		InviteOnly  bool   `json:"invite_only"`
+	}
+
+	var lobbies []*Lobby
+	if state := request.URL.Query().Get("state"); state != "" {
+		lobbies = s.Lobbies.ByState(state)
+	} else {
+		lobbies = s.Lobbies.List()
+	}
+	lobbyList := make([]lobbyListType, 0, len(lobbies))
+
+	for _, lobby := range lobbies {
+		_ = lobby.Read(func() {
+			owner := *lobby.Owner
+			lobbyList = append(lobbyList, lobbyListType{
+				Id:          lobby.Id,
+				Owner:       &owner,
+				Users:       len(lobby.Users),
+				MaxPlayers:  lobby.Settings.MaxPlayers,
+				State:       lobby.State.StateType(),
+				Mode:        lobby.Settings.Mode,
+				Locked:      lobby.access.locked,
+				HasPassword: lobby.access.passwordHash != nil,
+				InviteOnly:  lobby.access.inviteOnly,
+			})
 		})
 	}
 
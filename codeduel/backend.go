@@ -3,7 +3,9 @@ package codeduel
 import (
 	"fmt"
 	"log"
+	"maps"
 	"strings"
+	"time"
 
 	"github.com/xedom/codeduel-lobby/codeduel/utils"
 )
@@ -53,36 +55,51 @@ func (backend *Backend) patch(path string, body any) (any, error) {
 	return jsonResponse, nil
 }
 
-func (backend *Backend) CreateLobby(lobby *Lobby) error {
-	log.Printf("Creating lobby %v", lobby)
-	_, err := backend.post("/v1/game", map[string]any{
-		"uniqueId":         lobby.Id,
+// CreateLobby registers a game built by Lobby.gameRecord.
+func (backend *Backend) CreateLobby(game map[string]any) error {
+	log.Printf("Creating game %v", game["uniqueId"])
+	_, err := backend.post("/v1/game", game)
+	return err
+}
+
+// gameRecord is what the backend stores of the round, taken inside the event
+// starting it so that the request can be sent outside.
+func (lobby *Lobby) gameRecord(state *GameLobbyState) map[string]any {
+	return map[string]any{
+		"uniqueId":         state.GameId,
+		"lobbyId":          lobby.Id,
+		"round":            state.Round,
+		"rounds":           state.Rounds,
 		"ownerId":          lobby.Owner.Id,
-		"users":            keys(lobby.Users),
-		"challengeId":      lobby.State.(GameLobbyState).Challenge.Id,
-		"modeId":           1,
+		"users":            keys(lobby.players(state.Eliminated)),
+		"challengeId":      state.Challenge.Id,
+		"modeId":           lobby.mode().Id(),
 		"ended":            false,
 		"maxPlayers":       lobby.Settings.MaxPlayers,
 		"allowedLanguages": strings.Join(lobby.Settings.AllowedLanguages, ","),
-		"gameDuration":     lobby.Settings.GameDuration,
-	})
-	return err
+		"gameDuration":     int(lobby.Settings.GameDuration / time.Second), // in seconds
+		"teams":            maps.Clone(lobby.teams),
+	}
 }
 
-func (backend *Backend) RegisterSubmission(lobby *Lobby, user User, runResult *RunResult) error {
-	_, err := backend.patch("/v1/game/"+lobby.Id+"/submit", map[string]any{
+func (backend *Backend) RegisterSubmission(gameId string, user *User, runResult *RunResult) error {
+	_, err := backend.patch("/v1/game/"+gameId+"/submit", map[string]any{
 		"userId":      user.Id,
-		"gameId":      lobby.Id,
+		"gameId":      gameId,
 		"code":        runResult.Code,
 		"language":    runResult.Language,
 		"testsPassed": runResult.PassedTests,
+		"wallTime":    runResult.WallTime,
+		"cpuTime":     runResult.CpuTime,
+		"runs":        runResult.Runs,
+		"timings":     timingsOf(runResult.Results),
 		"submittedAt": runResult.Date.String(),
 	})
 	return err
 }
 
-func (backend *Backend) EndLobby(lobby *Lobby) error {
-	_, err := backend.patch("/v1/game/"+lobby.Id+"/endgame", map[string]any{})
+func (backend *Backend) EndLobby(gameId string) error {
+	_, err := backend.patch("/v1/game/"+gameId+"/endgame", map[string]any{})
 	return err
 }
 
@@ -113,3 +130,16 @@ func keys[K comparable, V any](dict map[K]V) []K {
 	}
 	return keys
 }
+
+// timingsOf returns the wall and CPU time of each test, in milliseconds,
+// null when the runner did not time it.
+func timingsOf(results []ExecutionResult) []map[string]*float64 {
+	timings := make([]map[string]*float64, 0, len(results))
+	for _, result := range results {
+		timings = append(timings, map[string]*float64{
+			"wallTime": result.WallTime,
+			"cpuTime":  result.CpuTime,
+		})
+	}
+	return timings
+}
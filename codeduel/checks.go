@@ -0,0 +1,68 @@
+package codeduel
+
+// checkQueue runs the checks of a user one at a time. A check that is still
+// waiting when a newer one arrives is superseded by it.
+type checkQueue struct {
+	pending *queuedCheck
+}
+
+type queuedCheck struct {
+	header PacketHeader
+	packet PacketInCheck
+}
+
+// pushCheck queues the check. It returns the check that was superseded, if
+// any, and whether the caller has to start running the queue.
+func (lobby *Lobby) pushCheck(user *User, check *queuedCheck) (superseded *queuedCheck, start bool) {
+	queue, running := lobby.checks[user.Id]
+	if !running {
+		lobby.checks[user.Id] = &checkQueue{}
+		return nil, true
+	}
+	superseded = queue.pending
+	queue.pending = check
+	return superseded, false
+}
+
+// nextCheck returns the check waiting to run, or nil once the queue of the
+// user is empty.
+func (lobby *Lobby) nextCheck(user *User) *queuedCheck {
+	queue, ok := lobby.checks[user.Id]
+	if !ok || queue.pending == nil {
+		delete(lobby.checks, user.Id)
+		return nil
+	}
+	check := queue.pending
+	queue.pending = nil
+	return check
+}
+
+// queueCheck runs the check in the background, so that a slow runner does
+// not stop the user from sending other packets.
+func (s *APIServer) queueCheck(check *queuedCheck, lobby *Lobby, user *User) error {
+	var superseded *queuedCheck
+	var start bool
+	err := lobby.Read(func() { superseded, start = lobby.pushCheck(user, check) })
+	if err != nil {
+		return err
+	}
+	if superseded != nil {
+		err := NewLobbyError(ErrorSuperseded, "check superseded by a newer one")
+		_ = s.sendError(lobby, user, superseded.header, err)
+	}
+	if !start {
+		return nil
+	}
+	go func() {
+		for check != nil {
+			err := s.handlePacketCheck(check.packet, check.header, lobby, user)
+			if err != nil {
+				_ = s.sendError(lobby, user, check.header, err)
+			}
+			if lobby.Read(func() { check = lobby.nextCheck(user) }) != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
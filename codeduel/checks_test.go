@@ -0,0 +1,39 @@
+package codeduel
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestRequestIds(t *testing.T) {
+	_, server := newTestServer(t)
+	owner, _ := createLobby(t, server, "u1")
+	owner.send(map[string]any{"type": "kick", "userId": 9, "requestId": "kick"})
+	if err := owner.until("error"); err["requestId"] != "kick" {
+		t.Fatal(err)
+	}
+
+	startGame(owner, classicSettings(60))
+	// the second check is still waiting when the third replaces it
+	for _, requestId := range []string{"c1", "c2", "c3"} {
+		owner.send(map[string]any{"type": "check", "code": "ok", "language": "go", "requestId": requestId})
+	}
+	var responses []string
+	for len(responses) < 3 {
+		var packet map[string]any
+		if err := owner.ReadJSON(&packet); err != nil {
+			t.Fatal(err)
+		}
+		switch packet["type"] {
+		case "checkResult":
+			responses = append(responses, fmt.Sprint(packet["requestId"], " result"))
+		case "error":
+			responses = append(responses, fmt.Sprint(packet["requestId"], " ", packet["code"]))
+		}
+	}
+	sort.Strings(responses)
+	if got := fmt.Sprint(responses); got != "[c1 result c2 superseded c3 result]" {
+		t.Fatal(got)
+	}
+}
@@ -2,188 +2,580 @@ package codeduel
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"slices"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 )
 
 const (
 	InternalServerError = 1011
+	ServiceRestart      = 1012
 	Timeout             = 4400
 	Unauthorized        = 4401
 	Forbidden           = 4403
 	NotFound            = 4404
+	SlowConsumer        = 4408
+	UnsupportedProtocol = 4406
+	Replaced            = 4409
+	// the reasons a user cannot join a lobby
+	LobbyLocked   = 4423
+	LobbyFull     = 4429
+	WrongPassword = 4430
+	NotInvited    = 4431
+	LobbyStarted  = 4432
+	// Kicked closes the connection of a user kicked by the owner
+	Kicked = 4433
 )
 
 const (
+	// maxMessageSize is the size of a packet without its code
 	maxMessageSize = 1024
+	sendQueueSize  = 64
+	writeWait      = 10 * time.Second
+	pongWait       = 60 * time.Second
+	pingPeriod     = pongWait * 9 / 10
 )
 
+var ErrClientClosed = errors.New("client is closed")
+var ErrSlowConsumer = errors.New("client send queue is full")
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
 	CheckOrigin:     func(r *http.Request) bool { return true },
+	// permessage-deflate, used only with the clients that support it
+	EnableCompression: true,
+}
+
+// Client wraps a websocket connection. Every write goes through a bounded
+// queue drained by a single writer goroutine, which also keeps the
+// connection alive with pings. A newer lobby update replaces the one still
+// waiting in the queue, and clients that cannot keep up with their queue
+// anyway are disconnected.
+type Client struct {
+	// Protocol and Codec are negotiated during the handshake.
+	Protocol   ProtocolVersion
+	Codec      Codec
+	connection *websocket.Conn
+	mutex      sync.Mutex
+	queue      []queuedMessage
+	// wake tells the writer that the queue is not empty
+	wake      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	close     closeFrame
+}
+
+// queuedMessage is an encoded message waiting for the writer. The messages
+// that only carry the latest users or lobby changes keep their packet, so
+// that a newer one can be merged into them.
+type queuedMessage struct {
+	bytes   []byte
+	message *outboundMessage
+}
+
+type closeFrame struct {
+	code    int
+	message string
+	flush   bool
+}
+
+func NewClient(connection *websocket.Conn, handshake Handshake, readLimit int64) *Client {
+	client := &Client{
+		Protocol:   handshake.Version,
+		Codec:      handshake.Codec,
+		connection: connection,
+		wake:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	connection.SetReadLimit(readLimit)
+	_ = connection.SetReadDeadline(time.Now().Add(pongWait))
+	connection.SetPongHandler(func(string) error {
+		return connection.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	go client.writePump()
+	return client
+}
+
+// Close flushes the messages already queued, sends a close frame and closes
+// the connection. Only the first call has any effect.
+func (client *Client) Close(code int, message string) {
+	client.shutdown(closeFrame{code: code, message: message, flush: true})
+}
+
+func (client *Client) shutdown(frame closeFrame) {
+	client.closeOnce.Do(func() {
+		client.close = frame
+		close(client.done)
+	})
+}
+
+// enqueue never blocks, a client whose queue is full is evicted.
+func (client *Client) enqueue(item queuedMessage) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	select {
+	case <-client.done:
+		return ErrClientClosed
+	default:
+	}
+	if item.message != nil {
+		var err error
+		if item, err = client.coalesce(item); err != nil {
+			return err
+		}
+	}
+	if len(client.queue) >= sendQueueSize {
+		client.shutdown(closeFrame{code: SlowConsumer, message: "too slow to receive messages"})
+		return ErrSlowConsumer
+	}
+	client.queue = append(client.queue, item)
+	select {
+	case client.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// coalesce removes the queued message of the same kind as item, if any, and
+// returns item merged with it. Only the mergeable messages at the end of the
+// queue are looked at, so that the order of the other packets is kept.
+func (client *Client) coalesce(item queuedMessage) (queuedMessage, error) {
+	for i := len(client.queue) - 1; i >= 0 && client.queue[i].message != nil; i-- {
+		merged := mergeMessages(client.queue[i].message, item.message)
+		if merged == nil {
+			continue
+		}
+		bytes, err := merged.encode(client.Protocol, client.Codec)
+		if err != nil {
+			return item, err
+		}
+		client.queue = slices.Delete(client.queue, i, i+1)
+		return queuedMessage{bytes: bytes, message: merged}, nil
+	}
+	return item, nil
+}
+
+// mergeMessages returns the message replacing both pending and next, or nil
+// when they cannot be merged. A users update supersedes the previous one,
+// while lobby patches are concatenated.
+func mergeMessages(pending *outboundMessage, next *outboundMessage) *outboundMessage {
+	switch nextPacket := next.packet.(type) {
+	case PacketOutUsersUpdate:
+		if _, ok := pending.packet.(PacketOutUsersUpdate); ok {
+			return next
+		}
+	case PacketOutLobbyPatch:
+		if pendingPacket, ok := pending.packet.(PacketOutLobbyPatch); ok {
+			patch := append(slices.Clip(pendingPacket.Patch), nextPacket.Patch...)
+			return &outboundMessage{
+				packet: PacketOutLobbyPatch{Base: pendingPacket.Base, Version: nextPacket.Version, Patch: patch},
+				seq:    next.seq,
+			}
+		}
+	}
+	return nil
+}
+
+// coalescable reports whether a newer packet can replace this one while it
+// waits in the queue.
+func coalescable(packet any) bool {
+	switch packet.(type) {
+	case PacketOutUsersUpdate, PacketOutLobbyPatch:
+		return true
+	}
+	return false
+}
+
+// pop returns the next queued message, if any.
+func (client *Client) pop() ([]byte, bool) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if len(client.queue) == 0 {
+		return nil, false
+	}
+	message := client.queue[0].bytes
+	client.queue[0] = queuedMessage{}
+	client.queue = client.queue[1:]
+	return message, true
+}
+
+func (client *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		_ = client.connection.Close()
+	}()
+	for {
+		select {
+		case <-client.wake:
+			if err := client.flush(); err != nil {
+				client.shutdown(closeFrame{code: websocket.CloseAbnormalClosure})
+				return
+			}
+		case <-ticker.C:
+			if err := client.write(websocket.PingMessage, nil); err != nil {
+				client.shutdown(closeFrame{code: websocket.CloseAbnormalClosure})
+				return
+			}
+		case <-client.done:
+			if client.close.flush {
+				_ = client.flush()
+			}
+			closeMessage := websocket.FormatCloseMessage(client.close.code, client.close.message)
+			_ = client.write(websocket.CloseMessage, closeMessage)
+			return
+		}
+	}
 }
 
+// flush writes the queued messages until the queue is empty.
+func (client *Client) flush() error {
+	for {
+		message, ok := client.pop()
+		if !ok {
+			return nil
+		}
+		if err := client.write(client.Codec.FrameType(), message); err != nil {
+			return err
+		}
+	}
+}
+
+func (client *Client) write(messageType int, data []byte) error {
+	_ = client.connection.SetWriteDeadline(time.Now().Add(writeWait))
+	return client.connection.WriteMessage(messageType, data)
+}
+
+// RejectConnection completes the handshake only to send the close code.
+// Browsers fail the handshake when none of the subprotocols they offered
+// is accepted, so the first one is echoed back.
 func RejectConnection(response http.ResponseWriter, request *http.Request, code int, message string) error {
-	connection, err := upgrader.Upgrade(response, request, nil)
+	var header http.Header
+	if offered := websocket.Subprotocols(request); len(offered) > 0 {
+		header = http.Header{"Sec-WebSocket-Protocol": {offered[0]}}
+	}
+	connection, err := upgrader.Upgrade(response, request, header)
 	if err != nil {
 		return err
 	}
-	closeMessage := websocket.FormatCloseMessage(code, message)
-	if err := connection.WriteMessage(websocket.CloseMessage, closeMessage); err != nil {
-		return err
+	defer connection.Close()
+	closeMessage := websocket.FormatCloseMessage(code, truncateCloseReason(message))
+	return connection.WriteMessage(websocket.CloseMessage, closeMessage)
+}
+
+// truncateCloseReason fits the reason in a close frame, whose payload is
+// limited to 125 bytes including the code.
+func truncateCloseReason(reason string) string {
+	const maxReasonSize = 123
+	if len(reason) <= maxReasonSize {
+		return reason
+	}
+	for end := maxReasonSize; end > 0; end-- {
+		if utf8.RuneStart(reason[end]) {
+			return reason[:end]
+		}
 	}
-	return connection.Close()
+	return ""
 }
 
-func (s *APIServer) StartWebSocket(response http.ResponseWriter, request *http.Request, lobby *Lobby, user *User) (*websocket.Conn, error) {
-	connection, err := upgrader.Upgrade(response, request, nil)
+func (s *APIServer) StartWebSocket(response http.ResponseWriter, request *http.Request, lobby *Lobby, user *User, handshake Handshake) (*Client, error) {
+	connection, err := upgrader.Upgrade(response, request, handshake.header())
 	if err != nil {
 		return nil, err
 	}
+	client := NewClient(connection, handshake, s.maxPacketSize())
+	lastSeq := parseLastSeq(request)
 	go func() {
-		err := s.handleClient(connection, lobby, user)
+		err := s.handleClient(client, lobby, user, lastSeq)
 		if err != nil {
 			_ = fmt.Errorf("%v", err)
 		}
 	}()
-	return connection, nil
-}
-
-func (s *APIServer) handleClient(connection *websocket.Conn, lobby *Lobby, user *User) error {
-	connection.SetReadLimit(maxMessageSize)
-	user.Connection = connection
-	err := SendPacket(connection, PacketOutLobby{
-		LobbyID:  lobby.Id,
-		Settings: lobby.Settings,
-		Owner:    lobby.Owner,
-		Users:    lobby.Users,
-		State:    lobby.State,
-	})
+	return client, nil
+}
 
-	lobby.BroadcastPacket(PacketOutUsersUpdate{
-		Users:      lobby.Users,
-		ReadyUsers: lobby.GetReadyUsers(),
+// maxPacketSize leaves room for the largest code a lobby can accept, twice
+// its size as escaping can make it grow.
+func (s *APIServer) maxPacketSize() int64 {
+	return maxMessageSize + 2*int64(s.Config.MaxCodeSize)
+}
+
+func (s *APIServer) handleClient(client *Client, lobby *Lobby, user *User, lastSeq *uint64) error {
+	defer func() {
+		_ = lobby.Do(func() { lobby.SetOffline(user, client, s.Config.PresenceGracePeriod) })
+	}()
+	err := lobby.Call(func() error {
+		err := lobby.resume(client, user, lastSeq)
+		lobby.SetOnline(user, client)
+
+		lobby.BroadcastPacket(PacketOutUsersUpdate{
+			Users:      lobby.Users,
+			ReadyUsers: lobby.GetReadyUsers(),
+		})
+		return err
 	})
 	if err != nil {
+		client.Close(InternalServerError, "cannot send lobby")
 		return fmt.Errorf("error sending lobby packet: %v", err)
 	}
 	for {
 		var packet any
-		err := ReadPacket(connection, &packet)
-		if err != nil {
+		var packetError *PacketError
+		header, err := client.ReadPacket(&packet)
+		if err == nil {
+			err = s.handlePacket(packet, header, lobby, user)
+		} else if errors.Is(err, websocket.ErrReadLimit) {
+			client.Close(websocket.CloseMessageTooBig, "packet too large")
+			break
+		} else if !errors.As(err, &packetError) {
 			log.Printf("error while reading packet: %v\n", err)
-			closeMessage := websocket.FormatCloseMessage(Timeout, "connection timed out")
-			_ = connection.WriteMessage(websocket.CloseMessage, closeMessage)
+			client.Close(Timeout, "connection timed out")
+			break
+		}
+		if err != nil && !errors.Is(err, ErrLobbyClosed) {
+			err = s.sendError(lobby, user, header, err)
+		}
+		if errors.Is(err, ErrLobbyClosed) {
+			client.Close(websocket.CloseNormalClosure, "lobby closed")
 			break
 		}
-		_ = s.handlePacket(packet, lobby, user)
 	}
-	return connection.Close()
+	return nil
+}
+
+// sendError tells the user why the packet was rejected. Internal errors are
+// only logged, the user receives a generic message.
+func (s *APIServer) sendError(lobby *Lobby, user *User, header PacketHeader, err error) error {
+	code := ErrorCodeOf(err)
+	message := err.Error()
+	if code == ErrorInternal {
+		log.Printf("error while handling %v packet from user %v: %v\n", header.Type, user.Id, err)
+		message = "internal server error"
+	}
+	return lobby.Call(func() error {
+		return lobby.SendPacket(user, PacketOutError{
+			RequestId:  header.RequestId,
+			Code:       code,
+			Message:    message,
+			PacketType: header.Type,
+		})
+	})
 }
 
-func (s *APIServer) handlePacket(packet any, lobby *Lobby, user *User) error {
+// handlePacket is called from the client goroutine. Handlers that only touch
+// the lobby run entirely inside a lobby event, after checking that the current
+// phase accepts the packet, while start, check and submit leave the lobby
+// goroutine free during their slow calls and check the phase themselves.
+// Checks are queued and answered in the background.
+// A returned error is sent back to the user as a PacketOutError.
+func (s *APIServer) handlePacket(packet any, header PacketHeader, lobby *Lobby, user *User) error {
 	switch packet := packet.(type) {
-	case *PacketInSettings:
-		s.handlePacketSettings(*packet, lobby, user)
-	case *PacketInUserStatus:
-		s.handlePacketUserStatus(*packet, lobby, user)
 	case *PacketInStartLobby:
-		s.handlePacketStartLobby(*packet, lobby, user)
+		return s.handlePacketStartLobby(*packet, lobby, user)
 	case *PacketInCheck:
-		return s.handlePacketCheck(*packet, lobby, user)
+		return s.queueCheck(&queuedCheck{header: header, packet: *packet}, lobby, user)
 	case *PacketInSubmit:
-		return s.handlePacketSubmit(*packet, lobby, user)
-	case *PacketInLock:
-		return s.handlePacketLock(*packet, lobby, user)
-	case *PacketInDelete:
-		return s.handlePacketDelete(*packet, lobby, user)
-	case *PacketInReady:
-		return s.handlePacketReady(*packet, lobby, user)
-	case *PacketInKick:
-		return s.handlePacketKick(*packet, lobby, user)
+		return s.handlePacketSubmit(*packet, header, lobby, user)
+	case *PacketInResync:
+		// answered in every phase
+		var err error
+		if readErr := lobby.Read(func() { err = lobby.Resync(user, header.RequestId) }); readErr != nil {
+			return readErr
+		}
+		return err
+	case *PacketInTimeSync:
+		var err error
+		if readErr := lobby.Read(func() { err = lobby.handleTimeSync(*packet, header, user) }); readErr != nil {
+			return readErr
+		}
+		return err
+	case *PacketInSetPassword:
+		return s.handlePacketSetPassword(*packet, lobby, user)
 	}
-	return nil
+	return lobby.Call(func() error {
+		if err := lobby.Accept(user, packet); err != nil {
+			return err
+		}
+		switch packet := packet.(type) {
+		case *PacketInSettings:
+			return s.handlePacketSettings(*packet, header, lobby, user)
+		case *PacketInUserStatus:
+			return s.handlePacketUserStatus(*packet, lobby, user)
+		case *PacketInLock:
+			return s.handlePacketLock(*packet, lobby, user)
+		case *PacketInSetInvites:
+			return s.handlePacketSetInvites(*packet, lobby, user)
+		case *PacketInJoinTeam:
+			return s.handlePacketJoinTeam(*packet, lobby, user)
+		case *PacketInBalanceTeams:
+			return s.handlePacketBalanceTeams(*packet, lobby, user)
+		case *PacketInDelete:
+			return s.handlePacketDelete(*packet, lobby, user)
+		case *PacketInReady:
+			return s.handlePacketReady(*packet, lobby, user)
+		case *PacketInKick:
+			return s.handlePacketKick(*packet, lobby, user)
+		case *PacketInTransferOwnership:
+			return s.handlePacketTransferOwnership(*packet, lobby, user)
+		}
+		return nil
+	})
 }
 
-func (s *APIServer) handlePacketSettings(packet PacketInSettings, lobby *Lobby, _ *User) {
-	lobby.SetSettings(packet.Settings)
+func (s *APIServer) handlePacketSettings(packet PacketInSettings, header PacketHeader, lobby *Lobby, user *User) error {
+	if err := lobby.RequireOwner(user, "change the settings"); err != nil {
+		return err
+	}
+	return lobby.SetSettings(header.Protocol.DecodeSettings(packet.Settings))
 }
 
-func (s *APIServer) handlePacketUserStatus(packet PacketInUserStatus, lobby *Lobby, user *User) {
-	err := lobby.SetReadyState(user, packet.Status)
-	if err != nil {
-		log.Printf("error while setting user state: %v\n", err)
-	}
+func (s *APIServer) handlePacketUserStatus(packet PacketInUserStatus, lobby *Lobby, user *User) error {
+	return lobby.SetReadyState(user, packet.Status)
 }
 
-func (s *APIServer) handlePacketStartLobby(_ PacketInStartLobby, lobby *Lobby, user *User) {
-	if lobby.Owner.Id != user.Id {
-		log.Printf("user %v is not the owner of the lobby\n", user)
-		return
-	}
-	err := s.StartLobby(lobby, context.Background())
+func (s *APIServer) handlePacketStartLobby(_ PacketInStartLobby, lobby *Lobby, user *User) error {
+	err := lobby.Call(func() error {
+		return lobby.RequireOwner(user, "start the game")
+	})
 	if err != nil {
-		log.Printf("error while starting lobby: %v\n", err)
+		return err
 	}
+	return s.StartLobby(lobby, context.Background())
 }
 
-func (s *APIServer) handlePacketCheck(packet PacketInCheck, lobby *Lobby, user *User) error {
+// handlePacketCheck answers rejected checks with an error packet, while
+// failures of the runner are reported in the check result.
+func (s *APIServer) handlePacketCheck(packet PacketInCheck, header PacketHeader, lobby *Lobby, user *User) error {
 	result, err := lobby.RunTest(user, s.Runner, packet.Language, packet.Code)
+	if err != nil && isRejection(err) {
+		return err
+	}
 	if err != nil {
 		stringErr := fmt.Sprintf("err while running code: %v", err)
-		return SendPacket(user.Connection, PacketOutCheckResult{Error: &stringErr, Result: nil})
+		return lobby.Call(func() error {
+			return lobby.SendPacket(user, PacketOutCheckResult{RequestId: header.RequestId, Error: &stringErr, Result: nil})
+		})
 	}
-	return SendPacket(user.Connection, PacketOutCheckResult{Result: result.Results})
+	return lobby.Call(func() error {
+		return lobby.SendPacket(user, PacketOutCheckResult{RequestId: header.RequestId, Result: result.Results})
+	})
+}
+
+func (s *APIServer) handlePacketSubmit(packet PacketInSubmit, header PacketHeader, lobby *Lobby, user *User) error {
+	_, err := s.submit(packet, header, lobby, user)
+	return err
 }
 
-func (s *APIServer) handlePacketSubmit(packet PacketInSubmit, lobby *Lobby, user *User) error {
-	result, err := lobby.Submit(user, s.Runner, packet.Language, packet.Code)
+// submit is shared by the submit packet and the upload endpoint. The result
+// is sent to the connection of the user and returned, failures to send it
+// are only logged.
+func (s *APIServer) submit(packet PacketInSubmit, header PacketHeader, lobby *Lobby, user *User) (PacketOutSubmitResult, error) {
+	result, round, stored, err := lobby.Submit(user, s.Runner, packet.Language, packet.Code)
+	if err != nil && isRejection(err) {
+		return PacketOutSubmitResult{}, err
+	}
 	if err != nil {
 		stringErr := fmt.Sprintf("err while running code: %v", err)
-		return SendPacket(user.Connection, PacketOutSubmitResult{Error: &stringErr, Result: nil})
+		out := PacketOutSubmitResult{RequestId: header.RequestId, Error: &stringErr, Result: nil}
+		return out, lobby.Call(func() error {
+			if err := lobby.SendPacket(user, out); err != nil {
+				log.Printf("error while sending submit result to user %v: %v\n", user.Id, err)
+			}
+			return nil
+		})
 	}
-	err = s.Backend.RegisterSubmission(lobby, *user, result)
-	if err != nil {
-		_ = fmt.Errorf("err while registering submission: %v", err)
+	// the backend keeps the latest submission, a worse one is not registered
+	if stored {
+		err = s.Backend.RegisterSubmission(round.GameId, user, result)
+		if err != nil {
+			log.Printf("err while registering submission: %v\n", err)
+		}
 	}
-	return SendPacket(user.Connection, PacketOutSubmitResult{Result: result.Results})
+	out := PacketOutSubmitResult{RequestId: header.RequestId, Result: result.Results}
+	return out, lobby.Call(func() error {
+		if err := lobby.SendPacket(user, out); err != nil {
+			log.Printf("error while sending submit result to user %v: %v\n", user.Id, err)
+		}
+		lobby.CountSubmit(round)
+		return nil
+	})
 }
 
 func (s *APIServer) handlePacketLock(packet PacketInLock, lobby *Lobby, user *User) error {
-	if lobby.Owner.Id != user.Id {
-		log.Printf("user %v is not the owner of the lobby\n", user)
-		return nil
+	if err := lobby.RequireOwner(user, "lock the lobby"); err != nil {
+		return err
 	}
-	// TODO: implement locking of the lobby
-	// lobby.Settings.Locked = packet.Lock
-	log.Printf("TODO: lobby %v is now locked: %v\n", lobby.Id, packet.Lock)
+	lobby.SetLocked(packet.Lock)
 	return nil
 }
 
-func (s *APIServer) handlePacketDelete(_ PacketInDelete, lobby *Lobby, user *User) error {
-	if lobby.Owner.Id != user.Id {
-		log.Printf("user %v is not the owner of the lobby\n", user)
-		return nil
+// handlePacketSetPassword hashes the password outside the lobby goroutine,
+// between the checks and the update.
+func (s *APIServer) handlePacketSetPassword(packet PacketInSetPassword, lobby *Lobby, user *User) error {
+	allowed := func() error {
+		if err := lobby.Accept(user, &packet); err != nil {
+			return err
+		}
+		return lobby.RequireOwner(user, "set the password")
+	}
+	if err := lobby.Call(allowed); err != nil {
+		return err
 	}
-	err := s.DeleteLobby(lobby, context.Background())
+	passwordHash, err := hashPassword(packet.Password)
 	if err != nil {
-		log.Printf("error while deleting lobby: %v\n", err)
+		return err
 	}
+	return lobby.Call(func() error {
+		// the owner may have changed while hashing
+		if err := allowed(); err != nil {
+			return err
+		}
+		lobby.SetPasswordHash(passwordHash)
+		return nil
+	})
+}
+
+func (s *APIServer) handlePacketSetInvites(packet PacketInSetInvites, lobby *Lobby, user *User) error {
+	if err := lobby.RequireOwner(user, "change the invites"); err != nil {
+		return err
+	}
+	lobby.SetInvites(packet.InviteOnly, packet.UserIds)
 	return nil
 }
 
+func (s *APIServer) handlePacketJoinTeam(packet PacketInJoinTeam, lobby *Lobby, user *User) error {
+	return lobby.JoinTeam(user, packet.Team)
+}
+
+func (s *APIServer) handlePacketBalanceTeams(_ PacketInBalanceTeams, lobby *Lobby, user *User) error {
+	if err := lobby.RequireOwner(user, "balance the teams"); err != nil {
+		return err
+	}
+	return lobby.BalanceTeams()
+}
+
+func (s *APIServer) handlePacketDelete(_ PacketInDelete, lobby *Lobby, user *User) error {
+	if err := lobby.RequireOwner(user, "delete the lobby"); err != nil {
+		return err
+	}
+	return s.DeleteLobby(lobby, context.Background())
+}
+
 func (s *APIServer) handlePacketReady(packet PacketInReady, lobby *Lobby, user *User) error {
 	status := StatusNotReady
 	if packet.Ready {
 		status = StatusReady
 	}
-	err := lobby.SetReadyState(user, status)
-	if err != nil {
-		log.Printf("error while setting user state: %v\n", err)
+	if err := lobby.SetReadyState(user, status); err != nil {
+		return err
 	}
 
 	lobby.BroadcastPacket(PacketOutUsersUpdate{
@@ -195,19 +587,36 @@ func (s *APIServer) handlePacketReady(packet PacketInReady, lobby *Lobby, user *
 }
 
 func (s *APIServer) handlePacketKick(packet PacketInKick, lobby *Lobby, user *User) error {
-	if lobby.Owner.Id == user.Id {
-		log.Printf("user %v is the owner of the lobby\n", user)
-		return nil
+	if err := lobby.RequireOwner(user, "kick users"); err != nil {
+		return err
 	}
 
-	err := lobby.KickUser(packet.UserId)
-	if err != nil {
-		log.Printf("error while kicking user: %v\n", err)
+	kicked := lobby.Users[packet.UserId]
+	if err := lobby.KickUser(packet.UserId); err != nil {
+		return err
+	}
+	if kicked.Connection != nil {
+		kicked.Connection.Close(Kicked, "kicked from the lobby")
 	}
 
 	lobby.BroadcastPacket(PacketOutUsersUpdate{
-		Users: lobby.Users,
+		Users:      lobby.Users,
+		ReadyUsers: lobby.GetReadyUsers(),
 	})
 
 	return nil
 }
+
+func (s *APIServer) handlePacketTransferOwnership(packet PacketInTransferOwnership, lobby *Lobby, user *User) error {
+	if err := lobby.RequireOwner(user, "transfer the ownership"); err != nil {
+		return err
+	}
+	newOwner, ok := lobby.Users[packet.UserId]
+	if !ok {
+		return NewLobbyError(ErrorUserNotFound, "user %v is not in the lobby", packet.UserId)
+	}
+	if newOwner != user {
+		lobby.TransferOwnership(newOwner)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package codeduel
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestClientFlushesBeforeClosing(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connection, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := NewClient(connection, Handshake{Version: ProtocolV1, Codec: JSONCodec{}}, maxMessageSize)
+		for i := 0; i < 3; i++ {
+			_ = client.enqueue(queuedMessage{bytes: []byte(fmt.Sprint(i))})
+		}
+		client.Close(Replaced, "bye")
+	}))
+	defer server.Close()
+	connection, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	client := &testClient{connection, t}
+	for i := 0; i < 3; i++ {
+		if _, message, err := connection.ReadMessage(); err != nil || string(message) != fmt.Sprint(i) {
+			t.Fatal(string(message), err)
+		}
+	}
+	if reason := client.closeReason(); reason != "4409 bye" {
+		t.Fatal(reason)
+	}
+}
+
+func TestClientEvictsSlowConsumers(t *testing.T) {
+	client := &Client{wake: make(chan struct{}, 1), done: make(chan struct{})}
+	for i := 0; i < sendQueueSize; i++ {
+		if err := client.enqueue(queuedMessage{bytes: []byte(fmt.Sprint(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.enqueue(queuedMessage{bytes: []byte("full")}); !errors.Is(err, ErrSlowConsumer) {
+		t.Fatal(err)
+	}
+	if client.close.code != SlowConsumer {
+		t.Fatal(client.close)
+	}
+	if err := client.enqueue(queuedMessage{bytes: []byte("closed")}); !errors.Is(err, ErrClientClosed) {
+		t.Fatal(err)
+	}
+}
+
+func TestClientCoalescesLobbyUpdates(t *testing.T) {
+	patch := func(seq uint64, path string) *outboundMessage {
+		operation := PatchOperation{Op: "replace", Path: path, Value: seq}
+		return &outboundMessage{packet: PacketOutLobbyPatch{Base: seq - 1, Version: seq, Patch: []PatchOperation{operation}}, seq: seq}
+	}
+	client := &Client{Protocol: ProtocolV3, Codec: JSONCodec{}, wake: make(chan struct{}, 1), done: make(chan struct{})}
+	for _, message := range []*outboundMessage{
+		patch(1, "/a"),
+		{packet: PacketOutError{Code: ErrorInvalidValue}, seq: 2},
+		patch(3, "/b"),
+		patch(4, "/c"),
+	} {
+		if err := client.sendMessage(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the first patch is not merged past the error
+	if len(client.queue) != 3 {
+		t.Fatal(len(client.queue))
+	}
+	merged := client.queue[2].message.packet.(PacketOutLobbyPatch)
+	if merged.Base != 2 || merged.Version != 4 || len(merged.Patch) != 2 || merged.Patch[0].Path != "/b" || merged.Patch[1].Path != "/c" {
+		t.Fatal(merged)
+	}
+	if !strings.Contains(string(client.queue[2].bytes), `"seq":4`) {
+		t.Fatal(string(client.queue[2].bytes))
+	}
+
+	client = &Client{Protocol: ProtocolV1, Codec: JSONCodec{}, wake: make(chan struct{}, 1), done: make(chan struct{})}
+	for seq := uint64(1); seq <= 3; seq++ {
+		if err := client.sendMessage(&outboundMessage{packet: PacketOutUsersUpdate{}, seq: seq}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(client.queue) != 1 || client.queue[0].message.seq != 3 {
+		t.Fatal(client.queue)
+	}
+}
+
+func TestClientAbsorbsBursts(t *testing.T) {
+	_, httpServer := newTestServer(t)
+	owner, id := createLobby(t, httpServer, "u1")
+	player := joinLobby(t, httpServer, id, "u2", "codeduel.v3")
+	for i := 0; i < 200; i++ {
+		player.send(map[string]any{"type": "ready", "ready": i%2 == 0})
+	}
+	player.send(map[string]any{"type": "resync", "requestId": "resync"})
+	if packet := player.until("lobby"); packet["requestId"] != "resync" {
+		t.Fatal(packet)
+	}
+	// the other members keep receiving the updates
+	owner.send(map[string]any{"type": "resync", "requestId": "resync"})
+	if packet := owner.until("lobby"); packet["requestId"] != "resync" {
+		t.Fatal(packet)
+	}
+}
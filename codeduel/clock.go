@@ -0,0 +1,73 @@
+package codeduel
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	countdownTimerInterval = time.Second
+	gameTimerInterval      = 5 * time.Second
+)
+
+// SendVolatile sends a packet that only makes sense when received right
+// away, like a clock reading. It is not sequenced nor replayed, it carries
+// the sequence number of the latest packet instead.
+func (lobby *Lobby) SendVolatile(user *User, packet any) error {
+	return user.Connection.sendMessage(&outboundMessage{packet: packet, seq: lobby.replay.seq})
+}
+
+// BroadcastVolatile sends a volatile packet to every connected user.
+func (lobby *Lobby) BroadcastVolatile(packet any) {
+	volatile := &outboundMessage{packet: packet, seq: lobby.replay.seq}
+	for _, user := range lobby.Users {
+		if user.Connection != nil {
+			_ = user.Connection.sendMessage(volatile)
+		}
+	}
+}
+
+// runTimer broadcasts the time remaining until the deadline of the phase
+// every interval, until the deadline passes or ctx is cancelled.
+func (lobby *Lobby) runTimer(ctx context.Context, phase string, deadline time.Time, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		if !now.Before(deadline) {
+			return
+		}
+		err := lobby.PostRead(func() {
+			// the phase may have ended while the event was queued
+			if lobby.State.StateType() != phase {
+				return
+			}
+			lobby.BroadcastVolatile(PacketOutTimer{
+				Phase:      phase,
+				Deadline:   deadline,
+				Remaining:  time.Until(deadline).Milliseconds(),
+				ServerTime: time.Now().UnixMilli(),
+			})
+		})
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handleTimeSync answers a clock synchronisation request. With the client
+// send and receive times, the client computes the offset of its clock as
+// ((serverReceiveTime - clientTime) + (serverSendTime - clientReceiveTime)) / 2.
+func (lobby *Lobby) handleTimeSync(packet PacketInTimeSync, header PacketHeader, user *User) error {
+	return lobby.SendVolatile(user, PacketOutTimeSync{
+		RequestId:         header.RequestId,
+		ClientTime:        packet.ClientTime,
+		ServerReceiveTime: header.ReceivedAt.UnixMilli(),
+		ServerSendTime:    time.Now().UnixMilli(),
+	})
+}
@@ -0,0 +1,39 @@
+package codeduel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	server.Config.Countdown = 2 * time.Second
+	owner, _ := createLobby(t, httpServer, "u1")
+	sent := time.Now().UnixMilli()
+	owner.send(map[string]any{"type": "timeSync", "clientTime": sent, "requestId": "sync"})
+	sync := owner.until("timeSync")
+	if sync["requestId"] != "sync" || int64(sync["clientTime"].(float64)) != sent || sync["serverSendTime"].(float64) < sync["serverReceiveTime"].(float64) {
+		t.Fatal(sync)
+	}
+	if _, ok := sync["seq"]; !ok {
+		t.Fatal(sync)
+	}
+
+	owner.send(map[string]any{"type": "updateSettings", "settings": classicSettings(60)})
+	owner.send(map[string]any{"type": "start"})
+	owner.until("countdown")
+	timer := owner.until("timer")
+	if timer["phase"] != "countdown" || timer["remaining"].(float64) <= 0 || timer["remaining"].(float64) > 2000 {
+		t.Fatal(timer)
+	}
+	started := owner.until("gameStarted")
+	startTime, _ := time.Parse(time.RFC3339, started["startTime"].(string))
+	deadline, _ := time.Parse(time.RFC3339, started["deadline"].(string))
+	if deadline.Sub(startTime) != time.Minute {
+		t.Fatal(started)
+	}
+	timer = owner.until("timer")
+	if timer["phase"] != "game" || timer["remaining"].(float64) > 60000 {
+		t.Fatal(timer)
+	}
+}
@@ -0,0 +1,105 @@
+package codeduel
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec is the wire format of the packets of a connection. It is selected
+// during the handshake together with the protocol version.
+type Codec interface {
+	// Name is the suffix of the subprotocol selecting the codec.
+	Name() string
+	// FrameType is the websocket message type used for the encoded packets.
+	FrameType() int
+	Marshal(packet any) ([]byte, error)
+	Unmarshal(data []byte, packet any) error
+}
+
+var codecs = map[string]Codec{
+	JSONCodec{}.Name():    JSONCodec{},
+	MsgpackCodec{}.Name(): MsgpackCodec{},
+}
+
+// JSONCodec is the original text format.
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string   { return "json" }
+func (JSONCodec) FrameType() int { return websocket.TextMessage }
+
+func (JSONCodec) Marshal(packet any) ([]byte, error) {
+	return json.Marshal(packet)
+}
+
+func (JSONCodec) Unmarshal(data []byte, packet any) error {
+	return json.Unmarshal(data, packet)
+}
+
+// MsgpackCodec sends MessagePack in binary frames. Field names are the same
+// as in JSON and integral numbers are sent as integers.
+type MsgpackCodec struct{}
+
+// The packets keep the shape they have in JSON, so that the lobby patches,
+// built from the JSON document, apply to the lobby sent with msgpack: times
+// are RFC 3339 strings and the maps keyed by user have string keys.
+func init() {
+	msgpack.Register(time.Time{}, encodeTimeString, nil)
+	for _, users := range []any{
+		map[UserId]*User{},
+		map[UserId]int{},
+		map[UserId]UserGameLobbyState{},
+		map[UserId]legacyUserGameLobbyState{},
+	} {
+		msgpack.Register(users, encodeStringKeys, nil)
+	}
+}
+
+func encodeTimeString(encoder *msgpack.Encoder, value reflect.Value) error {
+	return encoder.EncodeString(value.Interface().(time.Time).Format(time.RFC3339Nano))
+}
+
+func encodeStringKeys(encoder *msgpack.Encoder, value reflect.Value) error {
+	if value.IsNil() {
+		return encoder.EncodeNil()
+	}
+	if err := encoder.EncodeMapLen(value.Len()); err != nil {
+		return err
+	}
+	entries := value.MapRange()
+	for entries.Next() {
+		if err := encoder.EncodeString(strconv.FormatInt(entries.Key().Int(), 10)); err != nil {
+			return err
+		}
+		if err := encoder.EncodeValue(entries.Value()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (MsgpackCodec) Name() string   { return "msgpack" }
+func (MsgpackCodec) FrameType() int { return websocket.BinaryMessage }
+
+func (MsgpackCodec) Marshal(packet any) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := msgpack.NewEncoder(&buffer)
+	encoder.SetCustomStructTag("json")
+	encoder.UseCompactInts(true)
+	encoder.UseCompactFloats(true)
+	if err := encoder.Encode(packet); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (MsgpackCodec) Unmarshal(data []byte, packet any) error {
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	decoder.SetCustomStructTag("json")
+	return decoder.Decode(packet)
+}
@@ -0,0 +1,70 @@
+package codeduel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMsgpack(t *testing.T) {
+	_, server := newTestServer(t)
+	owner := dialLobby(t, server, "/create", "u1", "codeduel.v2.msgpack", "codeduel.v2")
+	if owner.Subprotocol() != "codeduel.v2.msgpack" {
+		t.Fatal(owner.Subprotocol())
+	}
+	read := func() map[string]any {
+		messageType, message, err := owner.ReadMessage()
+		if err != nil || messageType != websocket.BinaryMessage {
+			t.Fatal(messageType, err)
+		}
+		var packet map[string]any
+		if err := (MsgpackCodec{}).Unmarshal(message, &packet); err != nil {
+			t.Fatal(err)
+		}
+		return packet
+	}
+	until := func(packetType string) map[string]any {
+		packet := read()
+		for packet["type"] != packetType {
+			packet = read()
+		}
+		return packet
+	}
+
+	lobby := read()
+	if lobby["type"] != "lobby" {
+		t.Fatal(lobby)
+	}
+	// the packets keep the shape of their JSON encoding
+	if _, ok := lobby["users"].(map[string]any)["1"]; !ok {
+		t.Fatal(lobby["users"])
+	}
+
+	message, err := (MsgpackCodec{}).Marshal(map[string]any{"type": "kick", "userId": 7, "requestId": "kick"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := owner.WriteMessage(websocket.BinaryMessage, message); err != nil {
+		t.Fatal(err)
+	}
+	packet := until("error")
+	if packet["code"] != "user_not_found" || packet["requestId"] != "kick" {
+		t.Fatal(packet)
+	}
+
+	message, err = (MsgpackCodec{}).Marshal(map[string]any{"type": "start"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := owner.WriteMessage(websocket.BinaryMessage, message); err != nil {
+		t.Fatal(err)
+	}
+	startTime, ok := until("countdown")["startTime"].(string)
+	if !ok {
+		t.Fatal("startTime is not a string")
+	}
+	if _, err := time.Parse(time.RFC3339Nano, startTime); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,150 @@
+package codeduel
+
+import (
+	"encoding/json"
+	"log"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// lobbyDocument is the lobby as seen by the clients, the content of
+// PacketOutLobby without the runs. After every event but the reads, the lobby
+// compares it with the current state and broadcasts the differences as a
+// JSON Patch with a new version.
+type lobbyDocument struct {
+	version uint64
+	value   any
+}
+
+// PatchOperation is a JSON Patch (RFC 6902) operation. Value is null for
+// remove operations.
+type PatchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value"`
+}
+
+// documentValue returns the lobby in the same form the clients receive it.
+func (lobby *Lobby) documentValue() (any, error) {
+	snapshot := lobby.snapshot(nil, "")
+	// the patches are only sent to the clients of ProtocolV3
+	snapshot.Settings = ProtocolV3.EncodeSettings(snapshot.Settings)
+	bytes, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	var value map[string]any
+	if err := json.Unmarshal(bytes, &value); err != nil {
+		return nil, err
+	}
+	// the version is not part of the document
+	delete(value, "version")
+	return value, nil
+}
+
+// snapshot returns the full lobby at the current document version, with
+// the runs of the user if any.
+func (lobby *Lobby) snapshot(user *User, requestId string) PacketOutLobby {
+	snapshot := PacketOutLobby{
+		RequestId: requestId,
+		Version:   lobby.document.version,
+		LobbyID:   lobby.Id,
+		Settings:  lobby.Settings,
+		Access:    lobby.access.public(),
+		Owner:     lobby.Owner,
+		Users:     lobby.Users,
+		Teams:     lobby.teams,
+		State:     lobby.State,
+	}
+	if state, ok := lobby.State.(*GameLobbyState); ok && user != nil {
+		if runs := state.UsersState[user.Id].runs; runs != (UserRuns{}) {
+			runs.user = user.Id
+			snapshot.Runs = &runs
+		}
+	}
+	return snapshot
+}
+
+// publishDocument broadcasts the changes made to the lobby since the last
+// version. It is called by the event loop after every event but the reads.
+func (lobby *Lobby) publishDocument() {
+	value, err := lobby.documentValue()
+	if err != nil {
+		log.Printf("error while building the document of lobby %v: %v\n", lobby.Id, err)
+		return
+	}
+	patch := diffDocuments(nil, "", lobby.document.value, value)
+	if len(patch) == 0 {
+		return
+	}
+	base := lobby.document.version
+	lobby.document.version++
+	lobby.document.value = value
+	lobby.BroadcastPacket(PacketOutLobbyPatch{Base: base, Version: lobby.document.version, Patch: patch})
+}
+
+// Resync sends the full lobby to a user whose document version does not
+// match the patches it receives.
+func (lobby *Lobby) Resync(user *User, requestId string) error {
+	if err := lobby.checkMember(user); err != nil {
+		return err
+	}
+	return lobby.SendPacket(user, lobby.snapshot(user, requestId))
+}
+
+// diffDocuments appends to patch the operations turning from into to.
+// Arrays that changed length are replaced as a whole.
+func diffDocuments(patch []PatchOperation, path string, from any, to any) []PatchOperation {
+	switch from := from.(type) {
+	case map[string]any:
+		to, ok := to.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(from)+len(to))
+		for key := range from {
+			keys = append(keys, key)
+		}
+		for key := range to {
+			if _, ok := from[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			fromValue, inFrom := from[key]
+			toValue, inTo := to[key]
+			keyPath := path + "/" + escapePointer(key)
+			switch {
+			case !inTo:
+				patch = append(patch, PatchOperation{Op: "remove", Path: keyPath})
+			case !inFrom:
+				patch = append(patch, PatchOperation{Op: "add", Path: keyPath, Value: toValue})
+			default:
+				patch = diffDocuments(patch, keyPath, fromValue, toValue)
+			}
+		}
+		return patch
+	case []any:
+		to, ok := to.([]any)
+		if !ok || len(from) != len(to) {
+			break
+		}
+		for i := range from {
+			patch = diffDocuments(patch, path+"/"+strconv.Itoa(i), from[i], to[i])
+		}
+		return patch
+	}
+	if reflect.DeepEqual(from, to) {
+		return patch
+	}
+	return append(patch, PatchOperation{Op: "replace", Path: path, Value: to})
+}
+
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+func escapePointer(key string) string {
+	return pointerEscaper.Replace(key)
+}
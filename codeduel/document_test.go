@@ -0,0 +1,203 @@
+package codeduel
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// applyPatch applies the operations of a lobbyPatch packet to doc.
+func applyPatch(t *testing.T, doc any, operations []any) any {
+	for _, operation := range operations {
+		operation := operation.(map[string]any)
+		path := operation["path"].(string)
+		if path == "" {
+			doc = operation["value"]
+			continue
+		}
+		parts := strings.Split(path[1:], "/")
+		current := doc
+		for _, part := range parts[:len(parts)-1] {
+			switch value := current.(type) {
+			case map[string]any:
+				current = value[part]
+			case []any:
+				i, _ := strconv.Atoi(part)
+				current = value[i]
+			}
+		}
+		last := parts[len(parts)-1]
+		switch value := current.(type) {
+		case map[string]any:
+			if operation["op"] != "remove" {
+				value[last] = operation["value"]
+			} else if _, ok := value[last]; ok {
+				delete(value, last)
+			} else {
+				t.Fatal("removing a missing value", path)
+			}
+		case []any:
+			i, _ := strconv.Atoi(last)
+			value[i] = operation["value"]
+		default:
+			t.Fatal("invalid path", path)
+		}
+	}
+	return doc
+}
+
+// documentOf strips the fields of a lobby packet that are not part of the
+// document.
+func documentOf(lobby map[string]any) map[string]any {
+	for _, field := range []string{"type", "seq", "version", "requestId", "runs"} {
+		delete(lobby, field)
+	}
+	return lobby
+}
+
+func TestLobbyPatches(t *testing.T) {
+	_, server := newTestServer(t)
+	owner := dialLobby(t, server, "/create", "u1", "codeduel.v3")
+	lobby := owner.until("lobby")
+	id := lobby["id"].(string)
+	version := lobby["version"].(float64)
+	var doc any = documentOf(lobby)
+
+	player := joinLobby(t, server, id, "u2")
+	player.send(map[string]any{"type": "updatePlayerStatus", "status": "ready"})
+	owner.send(map[string]any{"type": "updateSettings", "settings": map[string]any{"maxPlayers": 4, "gameDuration": 60000, "allowedLanguages": []string{"go"}}})
+	owner.send(map[string]any{"type": "resync", "requestId": "resync"})
+	for {
+		var packet map[string]any
+		_ = owner.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := owner.ReadJSON(&packet); err != nil {
+			t.Fatal(err)
+		}
+		switch packet["type"] {
+		case "usersUpdate":
+			t.Fatal("the patches replace usersUpdate")
+		case "lobbyPatch":
+			if packet["base"].(float64) != version {
+				t.Fatal("missing version", version+1, packet["base"])
+			}
+			version = packet["version"].(float64)
+			doc = applyPatch(t, doc, packet["patch"].([]any))
+		case "lobby":
+			if packet["requestId"] != "resync" || packet["version"].(float64) != version {
+				t.Fatal(packet)
+			}
+			patched, _ := json.Marshal(doc)
+			resynced, _ := json.Marshal(documentOf(packet))
+			if string(patched) != string(resynced) {
+				t.Fatalf("patched:\n%s\nresynced:\n%s", patched, resynced)
+			}
+			return
+		}
+	}
+}
+
+func TestDocumentHidesRuns(t *testing.T) {
+	_, server := newTestServer(t)
+	owner, id := createLobby(t, server, "u1", "codeduel.v3")
+	player := joinLobby(t, server, id, "u2", "codeduel.v3")
+	startGame(owner, map[string]any{"maxPlayers": 4, "gameDuration": 60000, "allowedLanguages": []string{"go"}}, player)
+	player.send(map[string]any{"type": "check", "code": "secret solution", "language": "go"})
+	player.until("checkResult")
+	player.send(map[string]any{"type": "submit", "code": "secret solution", "language": "go"})
+	player.until("submitResult")
+
+	// the others only see that the player submitted
+	owner.send(map[string]any{"type": "resync", "requestId": "resync"})
+	for {
+		var packet map[string]any
+		_ = owner.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := owner.ReadJSON(&packet); err != nil {
+			t.Fatal(err)
+		}
+		encoded, _ := json.Marshal(packet)
+		if strings.Contains(string(encoded), "secret solution") || strings.Contains(string(encoded), "submitResult\"") {
+			t.Fatalf("%s leaks the runs: %s", packet["type"], encoded)
+		}
+		if packet["type"] == "lobby" && packet["requestId"] == "resync" {
+			userState := packet["state"].(map[string]any)["usersState"].(map[string]any)["2"].(map[string]any)
+			if userState["submitted"] != true || userState["passedTests"] != 2.0 {
+				t.Fatal(userState)
+			}
+			break
+		}
+	}
+
+	// while the player gets their own runs back
+	player.send(map[string]any{"type": "resync", "requestId": "resync"})
+	lobby := player.until("lobby")
+	runs, ok := lobby["runs"].(map[string]any)
+	if !ok || runs["submitResult"].(map[string]any)["code"] != "secret solution" || runs["lastRunResult"] == nil {
+		t.Fatal(lobby["runs"])
+	}
+}
+
+func TestLegacyRuns(t *testing.T) {
+	_, server := newTestServer(t)
+	owner, id := createLobby(t, server, "u1")
+	player := joinLobby(t, server, id, "u2", "codeduel.v2")
+	startGame(owner, map[string]any{"maxPlayers": 4, "gameDuration": 60, "allowedLanguages": []string{"go"}}, player)
+	player.send(map[string]any{"type": "submit", "code": "secret solution", "language": "go"})
+	player.until("submitResult")
+
+	// the versions before the document read the runs in the usersState
+	player.send(map[string]any{"type": "resync", "requestId": "resync"})
+	lobby := player.until("lobby")
+	usersState := lobby["state"].(map[string]any)["usersState"].(map[string]any)
+	own := usersState["2"].(map[string]any)
+	if _, ok := lobby["runs"]; ok || own["submitResult"].(map[string]any)["code"] != "secret solution" || own["submitted"] != true {
+		t.Fatal(lobby)
+	}
+	owner.send(map[string]any{"type": "resync", "requestId": "resync"})
+	lobby = owner.until("lobby")
+	other := lobby["state"].(map[string]any)["usersState"].(map[string]any)["2"].(map[string]any)
+	if submitted, ok := other["submitResult"]; !ok || submitted != nil || other["submitted"] != true {
+		t.Fatal(other)
+	}
+
+	// msgpack keeps the usersState with the runs
+	runs := &UserRuns{SubmitResult: &RunResult{Code: "secret solution"}, user: 2}
+	state := &GameLobbyState{Type: StateGame, UsersState: map[UserId]UserGameLobbyState{2: {Submitted: true}}}
+	message := &outboundMessage{packet: PacketOutLobby{State: state, Runs: runs}}
+	bytes, err := message.encode(ProtocolV2, MsgpackCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]any
+	if err := (MsgpackCodec{}).Unmarshal(bytes, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	own = decoded["state"].(map[string]any)["usersState"].(map[string]any)["2"].(map[string]any)
+	if own["submitResult"].(map[string]any)["code"] != "secret solution" {
+		t.Fatal(decoded)
+	}
+}
+
+func TestListingSkipsPublishing(t *testing.T) {
+	apiServer, server := newTestServer(t)
+	_, id := createLobby(t, server, "u1")
+	lobby, _ := apiServer.Lobbies.Get(id)
+	var version uint64
+	// a stale document would be published by any event but the reads
+	_ = lobby.Read(func() {
+		version = lobby.document.version
+		lobby.document.value = nil
+	})
+	response, err := http.Get(server.URL + "/lobbies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = response.Body.Close()
+	_ = lobby.Read(func() {
+		if lobby.document.version != version {
+			t.Error("the listing published the document")
+		}
+	})
+}
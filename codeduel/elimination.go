@@ -0,0 +1,144 @@
+package codeduel
+
+import (
+	"maps"
+	"slices"
+)
+
+// EliminationSettings are the options of the elimination mode.
+//
+// Players are eliminated by their rank in the round, exactly as many as the
+// schedule says. The players sharing a rank are told apart by the tests
+// passed by their last run, then by who joined the lobby first.
+type EliminationSettings struct {
+	// Schedule is how many players are eliminated after each round, the
+	// last entry applies to the rounds past the end of the schedule.
+	Schedule []int `json:"schedule"`
+}
+
+// eliminations returns how many players are eliminated after round.
+func (settings EliminationSettings) eliminations(round int) int {
+	if round > len(settings.Schedule) {
+		return settings.Schedule[len(settings.Schedule)-1]
+	}
+	return settings.Schedule[round-1]
+}
+
+// rounds returns the last round of a match where players are still alive
+// before round.
+func (settings EliminationSettings) rounds(round int, players int) int {
+	for players > 1 {
+		players -= min(settings.eliminations(round), players-1)
+		if players > 1 {
+			round++
+		}
+	}
+	return round
+}
+
+// EliminationGameMode is implemented by the modes eliminating players after
+// each round, until one is left. Eliminated players stay in the lobby as
+// spectators.
+type EliminationGameMode interface {
+	GameMode
+	// Eliminate returns the players of the round leaderboard eliminated
+	// after it, at least one player is always left. The leaderboard has no
+	// ties left, see breakTies.
+	Eliminate(settings EliminationSettings, round int, leaderboard []LeaderboardEntry) []UserId
+}
+
+// EliminationMode follows the classic rules in every round, and eliminates
+// the players ranked last.
+type EliminationMode struct {
+	ClassicMode
+}
+
+func (EliminationMode) Name() string { return "elimination" }
+
+func (EliminationMode) Id() int { return 5 }
+
+func (EliminationMode) Eliminate(settings EliminationSettings, round int, leaderboard []LeaderboardEntry) []UserId {
+	eliminated := []UserId{}
+	count := max(min(settings.eliminations(round), len(leaderboard)-1), 0)
+	for _, entry := range leaderboard[len(leaderboard)-count:] {
+		eliminated = append(eliminated, entry.User.Id)
+	}
+	slices.Sort(eliminated)
+	return eliminated
+}
+
+// breakTies orders the players sharing a rank by the tests passed by their
+// last run in the round, then by the time they joined the lobby, so that
+// the schedule eliminates exactly the players it says.
+func breakTies(state *GameLobbyState, leaderboard []LeaderboardEntry) []LeaderboardEntry {
+	lastPassed := func(entry LeaderboardEntry) int {
+		if run := state.UsersState[entry.User.Id].runs.LastRunResult; run != nil {
+			return run.PassedTests
+		}
+		return 0
+	}
+	ordered := slices.Clone(leaderboard)
+	slices.SortStableFunc(ordered, func(a, b LeaderboardEntry) int {
+		if a.Rank != b.Rank {
+			return a.Rank - b.Rank
+		}
+		if passedA, passedB := lastPassed(a), lastPassed(b); passedA != passedB {
+			return passedB - passedA
+		}
+		return a.User.joinedAt.Compare(b.User.joinedAt)
+	})
+	return ordered
+}
+
+// eliminationMode returns the mode of the lobby if players are eliminated.
+func (lobby *Lobby) eliminationMode() (EliminationGameMode, bool) {
+	mode, ok := lobby.mode().(EliminationGameMode)
+	return mode, ok
+}
+
+// players returns the users of the lobby that are not eliminated.
+func (lobby *Lobby) players(eliminated map[UserId]int) map[UserId]*User {
+	if len(eliminated) == 0 {
+		return lobby.Users
+	}
+	players := maps.Clone(lobby.Users)
+	for userId := range eliminated {
+		delete(players, userId)
+	}
+	return players
+}
+
+// checkPlaying rejects the users eliminated from the match.
+func (state *GameLobbyState) checkPlaying(user *User) error {
+	if round, ok := state.Eliminated[user.Id]; ok {
+		return NewLobbyError(ErrorEliminated, "you were eliminated after round %d", round)
+	}
+	return nil
+}
+
+// eliminate removes the players ranked last in the round and tells the
+// lobby who was eliminated. It returns the eliminated users of the match,
+// with the round they were eliminated after.
+func (lobby *Lobby) eliminate(state *GameLobbyState, leaderboard []LeaderboardEntry) map[UserId]int {
+	mode, ok := lobby.eliminationMode()
+	if !ok {
+		return state.Eliminated
+	}
+	// the map of the round is still part of its state
+	eliminated := maps.Clone(state.Eliminated)
+	if eliminated == nil {
+		eliminated = map[UserId]int{}
+	}
+	out := mode.Eliminate(lobby.Settings.Elimination, state.Round, breakTies(state, leaderboard))
+	for _, userId := range out {
+		eliminated[userId] = state.Round
+	}
+	remaining := keys(lobby.players(eliminated))
+	slices.Sort(remaining)
+	lobby.BroadcastPacket(PacketOutPlayersEliminated{
+		Round:      state.Round,
+		Eliminated: out,
+		Remaining:  remaining,
+	})
+	return eliminated
+}
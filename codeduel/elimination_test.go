@@ -0,0 +1,95 @@
+package codeduel
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestEliminationMode(t *testing.T) {
+	_, server := newTestServer(t)
+	owner, id := createLobby(t, server, "u1")
+	second := joinLobby(t, server, id, "u2")
+	third := joinLobby(t, server, id, "u3")
+	owner.send(map[string]any{"type": "updateSettings", "settings": map[string]any{"mode": "elimination", "maxPlayers": 4, "gameDuration": 60, "allowedLanguages": []string{"go"}, "elimination": map[string]any{"schedule": []int{0}}}})
+	if err := owner.until("error"); err["code"] != "invalid_value" {
+		t.Fatal(err)
+	}
+	owner.send(map[string]any{"type": "updateSettings", "settings": map[string]any{"mode": "elimination", "maxPlayers": 4, "gameDuration": 60, "allowedLanguages": []string{"go"}}})
+	owner.send(map[string]any{"type": "start"})
+	if started := owner.until("gameStarted"); started["rounds"] != 2.0 {
+		t.Fatal(started)
+	}
+
+	for _, submission := range []struct {
+		player *testClient
+		code   string
+	}{{owner, "ok"}, {second, "ok"}, {third, "bad"}} {
+		submission.player.send(map[string]any{"type": "submit", "code": submission.code, "language": "go"})
+		submission.player.until("submitResult")
+	}
+	eliminated := owner.until("playersEliminated")
+	if fmt.Sprint(eliminated["eliminated"]) != "[3]" || fmt.Sprint(eliminated["remaining"]) != "[1 2]" {
+		t.Fatal(eliminated)
+	}
+	owner.until("roundEnded")
+	owner.until("gameStarted")
+
+	// the eliminated players only watch
+	third.until("gameStarted")
+	third.send(map[string]any{"type": "submit", "code": "ok", "language": "go"})
+	if err := third.until("error"); err["code"] != "eliminated" {
+		t.Fatal(err)
+	}
+	second.send(map[string]any{"type": "submit", "code": "bad", "language": "go"})
+	second.until("submitResult")
+	owner.send(map[string]any{"type": "submit", "code": "ok", "language": "go"})
+	owner.until("submitResult")
+	if eliminated := owner.until("playersEliminated"); fmt.Sprint(eliminated["remaining"]) != "[1]" {
+		t.Fatal(eliminated)
+	}
+
+	ended := owner.until("gameEnded")
+	scoreboard := ended["scoreboard"].([]any)
+	if len(scoreboard) != 3 || scoreboard[0].(map[string]any)["user"].(map[string]any)["id"] != 1.0 || scoreboard[1].(map[string]any)["eliminatedIn"] != 2.0 || scoreboard[2].(map[string]any)["eliminatedIn"] != 1.0 {
+		t.Fatal(scoreboard)
+	}
+	// the last round only ranks the players left
+	if len(ended["leaderboard"].([]any)) != 2 {
+		t.Fatal(ended)
+	}
+}
+
+func TestEliminateTies(t *testing.T) {
+	joined := time.Now()
+	for _, c := range []struct {
+		ranks []int
+		// passed are the tests passed by the last run of each player
+		passed []int
+		count  int
+		want   string
+	}{
+		{[]int{1, 2, 3}, []int{0, 0, 0}, 1, "[3]"},
+		// the players joined in the order of their ids
+		{[]int{1, 2, 2}, []int{0, 0, 0}, 1, "[3]"},
+		{[]int{1, 2, 2}, []int{0, 0, 1}, 1, "[2]"},
+		{[]int{1, 1, 1}, []int{0, 0, 0}, 1, "[3]"},
+		{[]int{1, 1, 1}, []int{0, 2, 1}, 2, "[1 3]"},
+		{[]int{1, 2, 3, 4}, []int{0, 0, 0, 0}, 2, "[3 4]"},
+		{[]int{1, 2, 2, 4}, []int{0, 0, 0, 0}, 2, "[3 4]"},
+		{[]int{1, 1, 3, 3}, []int{0, 0, 0, 0}, 3, "[2 3 4]"},
+		{[]int{1, 2}, []int{0, 0}, 5, "[2]"},
+	} {
+		state := &GameLobbyState{UsersState: map[UserId]UserGameLobbyState{}}
+		var leaderboard []LeaderboardEntry
+		for i, rank := range c.ranks {
+			user := &User{Id: UserId(i + 1), joinedAt: joined.Add(time.Duration(i) * time.Second)}
+			leaderboard = append(leaderboard, LeaderboardEntry{Rank: rank, User: user})
+			state.UsersState[user.Id] = UserGameLobbyState{runs: UserRuns{LastRunResult: &RunResult{PassedTests: c.passed[i]}}}
+		}
+		settings := EliminationSettings{Schedule: []int{c.count}}
+		if got := fmt.Sprint(EliminationMode{}.Eliminate(settings, 1, breakTies(state, leaderboard))); got != c.want {
+			t.Errorf("%v passing %v eliminating %d: got %s, want %s", c.ranks, c.passed, c.count, got, c.want)
+		}
+	}
+}
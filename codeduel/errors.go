@@ -0,0 +1,138 @@
+package codeduel
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrorCode is the machine-readable reason sent to clients in a
+// PacketOutError. The values are part of the protocol and must not change.
+type ErrorCode string
+
+const (
+	ErrorUnknownPacket    ErrorCode = "unknown_packet"
+	ErrorMalformedPacket  ErrorCode = "malformed_packet"
+	ErrorInvalidState     ErrorCode = "invalid_state"
+	ErrorNotOwner         ErrorCode = "not_owner"
+	ErrorInvalidValue     ErrorCode = "invalid_value"
+	ErrorUserNotFound     ErrorCode = "user_not_found"
+	ErrorInvalidTarget    ErrorCode = "invalid_target"
+	ErrorAlreadySubmitted ErrorCode = "already_submitted"
+	ErrorSuperseded       ErrorCode = "superseded"
+	ErrorEliminated       ErrorCode = "eliminated"
+	ErrorNotMember        ErrorCode = "not_member"
+	ErrorCodeTooLarge     ErrorCode = "code_too_large"
+	ErrorNotAuthorized    ErrorCode = "not_authorized"
+	ErrorLobbyFull        ErrorCode = "lobby_full"
+	ErrorLobbyLocked      ErrorCode = "lobby_locked"
+	ErrorWrongPassword    ErrorCode = "wrong_password"
+	ErrorNotInvited       ErrorCode = "not_invited"
+	ErrorLobbyNotFound    ErrorCode = "lobby_not_found"
+	ErrorLobbyClosed      ErrorCode = "lobby_closed"
+	ErrorShuttingDown     ErrorCode = "shutting_down"
+	ErrorInternal         ErrorCode = "internal_error"
+)
+
+// LobbyError is returned when an action is rejected for a reason the user
+// should be told about.
+type LobbyError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (err *LobbyError) Error() string {
+	return err.Message
+}
+
+func NewLobbyError(code ErrorCode, format string, args ...any) *LobbyError {
+	return &LobbyError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// PacketError is returned when an inbound message cannot be decoded. The
+// connection stays open, the client only receives an error packet.
+type PacketError struct {
+	Code       ErrorCode
+	PacketType string
+	Err        error
+}
+
+func (err *PacketError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *PacketError) Unwrap() error {
+	return err.Err
+}
+
+// ErrorCodeOf maps any error returned by the handlers to its error code.
+func ErrorCodeOf(err error) ErrorCode {
+	var lobbyError *LobbyError
+	var packetError *PacketError
+	var stateError *StateError
+	var transitionError *TransitionError
+	switch {
+	case errors.As(err, &lobbyError):
+		return lobbyError.Code
+	case errors.As(err, &packetError):
+		return packetError.Code
+	case errors.As(err, &stateError), errors.As(err, &transitionError):
+		return ErrorInvalidState
+	case errors.Is(err, ErrLobbyClosed):
+		return ErrorLobbyClosed
+	case errors.Is(err, ErrShuttingDown):
+		return ErrorShuttingDown
+	}
+	return ErrorInternal
+}
+
+// httpStatusOf maps an error code to the status of the HTTP endpoints.
+func httpStatusOf(code ErrorCode) int {
+	switch code {
+	case ErrorUnknownPacket, ErrorMalformedPacket, ErrorInvalidValue, ErrorInvalidTarget:
+		return http.StatusBadRequest
+	case ErrorNotAuthorized:
+		return http.StatusUnauthorized
+	case ErrorNotOwner, ErrorWrongPassword, ErrorNotInvited, ErrorEliminated, ErrorNotMember:
+		return http.StatusForbidden
+	case ErrorLobbyLocked:
+		return http.StatusLocked
+	case ErrorUserNotFound, ErrorLobbyNotFound:
+		return http.StatusNotFound
+	case ErrorInvalidState, ErrorAlreadySubmitted, ErrorSuperseded, ErrorLobbyFull:
+		return http.StatusConflict
+	case ErrorLobbyClosed:
+		return http.StatusGone
+	case ErrorCodeTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case ErrorShuttingDown:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// joinCloseCodeOf maps the reason a user cannot join a lobby to the close
+// code rejecting the connection.
+func joinCloseCodeOf(code ErrorCode) int {
+	switch code {
+	case ErrorLobbyLocked:
+		return LobbyLocked
+	case ErrorLobbyFull:
+		return LobbyFull
+	case ErrorWrongPassword:
+		return WrongPassword
+	case ErrorNotInvited:
+		return NotInvited
+	case ErrorInvalidState:
+		return LobbyStarted
+	case ErrorLobbyClosed:
+		return NotFound
+	}
+	return InternalServerError
+}
+
+// isRejection reports whether the error means the action was refused, as
+// opposed to failing while it was carried out.
+func isRejection(err error) bool {
+	return ErrorCodeOf(err) != ErrorInternal
+}
@@ -0,0 +1,41 @@
+package codeduel
+
+import (
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestErrorPackets(t *testing.T) {
+	_, server := newTestServer(t)
+	owner, id := createLobby(t, server, "u1")
+	player := joinLobby(t, server, id, "u2")
+
+	player.send(map[string]any{"type": "nope"})
+	if err := player.until("error"); err["code"] != "unknown_packet" || err["packetType"] != "nope" {
+		t.Fatal(err)
+	}
+	if err := player.WriteMessage(websocket.TextMessage, []byte("{bad")); err != nil {
+		t.Fatal(err)
+	}
+	if err := player.until("error"); err["code"] != "malformed_packet" {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		packet map[string]any
+		code   string
+	}{
+		{map[string]any{"type": "kick", "userId": "x"}, "malformed_packet"},
+		{map[string]any{"type": "start"}, "not_owner"},
+		{map[string]any{"type": "check", "code": "x", "language": "go"}, "invalid_state"},
+	} {
+		player.send(c.packet)
+		if err := player.until("error"); err["code"] != c.code {
+			t.Errorf("%v: got %v, want %s", c.packet, err, c.code)
+		}
+	}
+	owner.send(map[string]any{"type": "kick", "userId": 9})
+	if err := owner.until("error"); err["code"] != "user_not_found" {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,129 @@
+package codeduel
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	lobbyEventQueueSize = 64
+)
+
+var ErrLobbyClosed = errors.New("lobby is closed")
+
+// lobbyEvent is a function run on the lobby goroutine. The events that
+// only read the lobby document skip publishing it.
+type lobbyEvent struct {
+	fn   func()
+	read bool
+}
+
+// run executes the lobby events one at a time until the lobby is closed.
+// Every read or write of the lobby fields has to happen inside an event.
+// The changes made by each event are then published to the clients.
+func (lobby *Lobby) run() {
+	defer close(lobby.closed)
+	for !lobby.stopped {
+		event := <-lobby.events
+		event.fn()
+		if !lobby.stopped && !event.read {
+			lobby.publishDocument()
+		}
+	}
+}
+
+// Do runs fn on the lobby goroutine and waits for it to return. Calling it
+// from inside an event deadlocks.
+func (lobby *Lobby) Do(fn func()) error {
+	return lobby.do(context.Background(), lobbyEvent{fn: fn})
+}
+
+// DoContext is Do giving up when ctx is done. fn may still run afterwards
+// if it was already queued.
+func (lobby *Lobby) DoContext(ctx context.Context, fn func()) error {
+	return lobby.do(ctx, lobbyEvent{fn: fn})
+}
+
+// Read is Do for functions that do not change the lobby document.
+func (lobby *Lobby) Read(fn func()) error {
+	return lobby.do(context.Background(), lobbyEvent{fn: fn, read: true})
+}
+
+func (lobby *Lobby) do(ctx context.Context, event lobbyEvent) error {
+	done := make(chan struct{})
+	fn := event.fn
+	event.fn = func() {
+		defer close(done)
+		fn()
+	}
+	select {
+	case lobby.events <- event:
+	case <-lobby.closed:
+		return ErrLobbyClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-lobby.closed:
+		// the loop closes the channel only after the running event returned,
+		// so done is already closed if fn was executed
+		select {
+		case <-done:
+			return nil
+		default:
+			return ErrLobbyClosed
+		}
+	}
+}
+
+// Post enqueues fn on the lobby goroutine without waiting for it.
+func (lobby *Lobby) Post(fn func()) error {
+	return lobby.post(lobbyEvent{fn: fn})
+}
+
+// PostRead is Post for functions that do not change the lobby document.
+func (lobby *Lobby) PostRead(fn func()) error {
+	return lobby.post(lobbyEvent{fn: fn, read: true})
+}
+
+func (lobby *Lobby) post(event lobbyEvent) error {
+	select {
+	case lobby.events <- event:
+		return nil
+	case <-lobby.closed:
+		return ErrLobbyClosed
+	}
+}
+
+// Close stops the event loop once the current event returns and
+// disconnects every user.
+func (lobby *Lobby) Close() {
+	_ = lobby.SetState(&ClosedLobbyState{Type: StateClosed})
+	lobby.stopped = true
+	lobby.DisconnectAll(websocket.CloseNormalClosure, "lobby closed")
+}
+
+// DisconnectAll closes the connection of every user with the given close
+// code.
+func (lobby *Lobby) DisconnectAll(code int, message string) {
+	for _, user := range lobby.Users {
+		if user.Connection != nil {
+			user.Connection.Close(code, message)
+		}
+	}
+}
+
+// Call is Do for functions returning an error.
+func (lobby *Lobby) Call(fn func() error) error {
+	var err error
+	if doErr := lobby.Do(func() { err = fn() }); doErr != nil {
+		return doErr
+	}
+	return err
+}
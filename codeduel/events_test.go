@@ -0,0 +1,41 @@
+package codeduel
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestLobbyEvents(t *testing.T) {
+	lobby := NewLobby(&User{Id: 1}, []string{"go"}, false, 1024)
+	counter := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = lobby.Do(func() { counter++ })
+		}()
+	}
+	wg.Wait()
+	if err := lobby.Read(func() {
+		if counter != 100 {
+			t.Errorf("counter is %d", counter)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	if err := lobby.Post(func() { close(done) }); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if err := lobby.Do(lobby.Close); err != nil {
+		t.Fatal(err)
+	}
+	if err := lobby.Do(func() {}); !errors.Is(err, ErrLobbyClosed) {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,174 @@
+package codeduel
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	GolfUnitBytes = "bytes"
+	GolfUnitChars = "chars"
+)
+
+// GolfSettings are the options of the golf mode, used to normalize the code
+// before measuring it.
+type GolfSettings struct {
+	// Unit is GolfUnitBytes or GolfUnitChars.
+	Unit            string `json:"unit"`
+	StripWhitespace bool   `json:"stripWhitespace"`
+	// StripComments removes the comments of the languages listed in
+	// commentSyntaxes, the code of other languages is measured as is.
+	StripComments bool `json:"stripComments"`
+}
+
+// GolfMode ranks the users by the length of their shortest submission
+// passing every hidden test. Users submit as many times as they want until
+// the deadline.
+type GolfMode struct{}
+
+func (GolfMode) Name() string { return "golf" }
+
+func (GolfMode) Id() int { return 2 }
+
+func (GolfMode) TestCases(challenge Challenge, submit bool) []TestCase {
+	return ClassicMode{}.TestCases(challenge, submit)
+}
+
+// Score sets the length of the code only when every test passes.
+func (GolfMode) Score(settings Settings, testCases []TestCase, result *RunResult) {
+	result.PassedTests = testsPassed(testCases, result.Results)
+	if result.PassedTests != len(testCases) {
+		return
+	}
+	length := golfLength(settings.Golf, result.Language, result.Code)
+	result.Score = &length
+}
+
+func (GolfMode) EndsEarly(map[UserId]*User, *GameLobbyState) error {
+	return nil
+}
+
+func (GolfMode) Leaderboard(users map[UserId]*User, state *GameLobbyState) []LeaderboardEntry {
+	return buildLeaderboard(users, state, compareLowestScore)
+}
+
+// Better keeps the shortest passing submission, the earliest on ties. Until
+// one passes, the submission passing the most tests is kept.
+func (GolfMode) Better(result *RunResult, previous *RunResult) bool {
+	if previous.Score == nil {
+		return result.Score != nil || result.PassedTests > previous.PassedTests
+	}
+	return result.Score != nil && *result.Score < *previous.Score
+}
+
+func golfLength(settings GolfSettings, language string, code string) int {
+	if settings.StripComments {
+		if syntax, ok := commentSyntaxes[language]; ok {
+			code = syntax.strip(code)
+		}
+	}
+	if settings.StripWhitespace {
+		code = strings.Map(func(r rune) rune {
+			if unicode.IsSpace(r) {
+				return -1
+			}
+			return r
+		}, code)
+	}
+	if settings.Unit == GolfUnitChars {
+		return utf8.RuneCountInString(code)
+	}
+	return len(code)
+}
+
+// commentSyntax describes the comments and string literals of a language.
+// Comment markers inside string literals are kept.
+type commentSyntax struct {
+	line       []string
+	blockStart string
+	blockEnd   string
+	quotes     string
+}
+
+var (
+	cStyleComments = commentSyntax{line: []string{"//"}, blockStart: "/*", blockEnd: "*/", quotes: `"'`}
+	hashComments   = commentSyntax{line: []string{"#"}, quotes: `"'`}
+)
+
+var commentSyntaxes = map[string]commentSyntax{
+	"c":          cStyleComments,
+	"cpp":        cStyleComments,
+	"csharp":     cStyleComments,
+	"java":       cStyleComments,
+	"kotlin":     cStyleComments,
+	"rust":       {line: []string{"//"}, blockStart: "/*", blockEnd: "*/", quotes: `"`},
+	"go":         {line: []string{"//"}, blockStart: "/*", blockEnd: "*/", quotes: "\"'`"},
+	"javascript": {line: []string{"//"}, blockStart: "/*", blockEnd: "*/", quotes: "\"'`"},
+	"typescript": {line: []string{"//"}, blockStart: "/*", blockEnd: "*/", quotes: "\"'`"},
+	"python":     hashComments,
+	"ruby":       hashComments,
+	"bash":       hashComments,
+	"lua":        {line: []string{"--"}, quotes: `"'`},
+}
+
+// strip removes the comments from the code. Line comments are removed up to
+// the end of the line, which is kept.
+func (syntax commentSyntax) strip(code string) string {
+	var builder strings.Builder
+	builder.Grow(len(code))
+	for i := 0; i < len(code); {
+		if quote := code[i]; strings.IndexByte(syntax.quotes, quote) >= 0 {
+			end := stringLiteralEnd(code, i)
+			builder.WriteString(code[i:end])
+			i = end
+			continue
+		}
+		if syntax.blockStart != "" && strings.HasPrefix(code[i:], syntax.blockStart) {
+			end := strings.Index(code[i+len(syntax.blockStart):], syntax.blockEnd)
+			if end < 0 {
+				break
+			}
+			i += len(syntax.blockStart) + end + len(syntax.blockEnd)
+			continue
+		}
+		if syntax.isLineComment(code[i:]) {
+			end := strings.IndexByte(code[i:], '\n')
+			if end < 0 {
+				break
+			}
+			i += end
+			continue
+		}
+		builder.WriteByte(code[i])
+		i++
+	}
+	return builder.String()
+}
+
+func (syntax commentSyntax) isLineComment(code string) bool {
+	for _, marker := range syntax.line {
+		if strings.HasPrefix(code, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// stringLiteralEnd returns the index after the literal starting at start,
+// honouring backslash escapes. Unterminated literals end with the code.
+func stringLiteralEnd(code string, start int) int {
+	quote := code[start]
+	for i := start + 1; i < len(code); i++ {
+		switch code[i] {
+		case '\\':
+			// raw strings have no escapes
+			if quote != '`' {
+				i++
+			}
+		case quote:
+			return i + 1
+		}
+	}
+	return len(code)
+}
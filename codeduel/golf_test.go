@@ -0,0 +1,123 @@
+package codeduel
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestGolfLength(t *testing.T) {
+	stripped := GolfSettings{Unit: GolfUnitBytes, StripComments: true, StripWhitespace: true}
+	for _, c := range []struct {
+		settings GolfSettings
+		language string
+		code     string
+		want     int
+	}{
+		{GolfSettings{Unit: GolfUnitBytes}, "python", "print('é') # x", 15},
+		{GolfSettings{Unit: GolfUnitChars}, "python", "print('é') # x", 14},
+		{stripped, "python", "print('é') # x\n", 11},
+		{stripped, "python", "print('#')", 10},
+		{stripped, "go", "a /* b */ + `//` // c", 6},
+		{stripped, "go", `"\" // x"`, 7},
+		{stripped, "cobol", "a # b", 3},
+	} {
+		if got := golfLength(c.settings, c.language, c.code); got != c.want {
+			t.Errorf("%+v %s %q: got %d, want %d", c.settings, c.language, c.code, got, c.want)
+		}
+	}
+}
+
+func TestGolfBetter(t *testing.T) {
+	score := func(score int) *int { return &score }
+	for _, c := range []struct {
+		result, previous RunResult
+		want             bool
+	}{
+		{RunResult{Score: score(3)}, RunResult{Score: score(4)}, true},
+		{RunResult{Score: score(4)}, RunResult{Score: score(4)}, false},
+		{RunResult{PassedTests: 1}, RunResult{Score: score(4)}, false},
+		{RunResult{Score: score(9)}, RunResult{PassedTests: 1}, true},
+		{RunResult{PassedTests: 1}, RunResult{PassedTests: 0}, true},
+		{RunResult{PassedTests: 1}, RunResult{PassedTests: 1}, false},
+	} {
+		if got := (GolfMode{}).Better(&c.result, &c.previous); got != c.want {
+			t.Errorf("%+v over %+v: got %v", c.result, c.previous, got)
+		}
+	}
+}
+
+// recordSubmissions points the server to a backend recording the code of
+// the registered submissions.
+func recordSubmissions(t *testing.T, server *APIServer) func() []string {
+	target, _ := url.Parse(fakeBackend(t, nil).URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	var mutex sync.Mutex
+	var codes []string
+	recorder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/submit") {
+			var body struct {
+				Code string `json:"code"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			mutex.Lock()
+			codes = append(codes, body.Code)
+			mutex.Unlock()
+			_, _ = w.Write([]byte("{}"))
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	t.Cleanup(recorder.Close)
+	backend := NewBackend(recorder.URL, "key")
+	server.Backend = &backend
+	return func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return slices.Clone(codes)
+	}
+}
+
+func TestGolfMode(t *testing.T) {
+	apiServer, server := newTestServer(t)
+	registered := recordSubmissions(t, apiServer)
+	owner, id := createLobby(t, server, "u1")
+	player := joinLobby(t, server, id, "u2")
+	startGame(owner, map[string]any{"mode": "golf", "maxPlayers": 4, "gameDuration": 60, "allowedLanguages": []string{"python"}, "golf": map[string]any{"stripComments": true, "stripWhitespace": true}})
+	score := func() any {
+		leaderboard := owner.until("leaderboard")["leaderboard"].([]any)
+		return leaderboard[0].(map[string]any)["score"]
+	}
+
+	// the shortest passing submission is kept
+	for _, c := range []struct {
+		code  string
+		score float64
+	}{
+		{"okk", 3},
+		{"o k # a long comment \"\n", 2},
+		{"bad", 2},
+	} {
+		owner.send(map[string]any{"type": "submit", "code": c.code, "language": "python"})
+		owner.until("submitResult")
+		if got := score(); got != c.score {
+			t.Errorf("%q: got %v, want %v", c.code, got, c.score)
+		}
+	}
+	// only the submissions replacing the kept one are registered
+	if codes := registered(); len(codes) != 2 || codes[1] != "o k # a long comment \"\n" {
+		t.Fatal(codes)
+	}
+	player.send(map[string]any{"type": "submit", "code": "'#'", "language": "python"})
+	player.until("submitResult")
+	leaderboard := owner.until("leaderboard")["leaderboard"].([]any)
+	if second := leaderboard[1].(map[string]any); second["score"] != 3.0 || second["rank"] != 2.0 {
+		t.Fatal(leaderboard)
+	}
+}
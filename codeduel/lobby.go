@@ -4,44 +4,64 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"slices"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/xedom/codeduel-lobby/codeduel/utils"
 )
 
+// Lobby is owned by its event loop: the fields and methods are only used
+// from inside the events run by Do, Read, Call and Post. The methods waiting for
+// slow calls, like RunTest and Submit, are the exception and run outside.
 type Lobby struct {
 	Id       string
 	Owner    *User
 	Users    map[UserId]*User
 	Settings Settings
-	State    any
+	State    LobbyState
+
+	events   chan lobbyEvent
+	closed   chan struct{}
+	stopped  bool
+	registry *LobbyRegistry
+	replay   replayBuffer
+	document lobbyDocument
+	checks   map[UserId]*checkQueue
+	access   lobbyAccess
+	// teams maps the users to their team in the teams mode
+	teams map[UserId]int
+	// languages are the ones supported by the runner when the lobby was created
+	languages []string
+	// timings tells whether the runner reports the time of each test
+	timings bool
+	// maxCodeSize caps Settings.MaxCodeSize to what the server accepts
+	maxCodeSize int
 }
 
-type Settings struct {
-	Mode             string        `json:"mode"`
-	MaxPlayers       int           `json:"maxPlayers"`
-	GameDuration     time.Duration `json:"gameDuration"`
-	AllowedLanguages []string      `json:"allowedLanguages"`
-}
-
-type PreLobbyState struct {
-	Type  string   `json:"type"`
-	Ready []UserId `json:"ready"`
-}
-
-type GameLobbyState struct {
-	Type        string                        `json:"type"`
-	Challenge   Challenge                     `json:"challenge"`
-	StartTime   time.Time                     `json:"startTime"`
-	UsersState  map[UserId]UserGameLobbyState `json:"usersState"`
-	SubmitCount int                           `json:"submitCount"`
-	context     context.CancelCauseFunc
+// UserGameLobbyState is what every user sees of a user during a round. The
+// runs, with their code, are only sent to the user who made them.
+type UserGameLobbyState struct {
+	Submitted   bool `json:"submitted"`
+	PassedTests int  `json:"passedTests"`
+	Score       *int `json:"score,omitempty"`
+	runs        UserRuns
 }
 
-type UserGameLobbyState struct {
+// UserRuns are the latest run and the submission of a user in a round.
+type UserRuns struct {
 	LastRunResult *RunResult `json:"lastRunResult"`
 	SubmitResult  *RunResult `json:"submitResult"`
+	// user made the runs, it is set once they are sent
+	user UserId
+}
+
+// submit stores the submission of the user and shows how it did.
+func (userState *UserGameLobbyState) submit(result *RunResult) {
+	userState.runs.SubmitResult = result
+	userState.Submitted = true
+	userState.PassedTests = result.PassedTests
+	userState.Score = result.Score
 }
 
 type RunResult struct {
@@ -49,7 +69,14 @@ type RunResult struct {
 	Language    string            `json:"language"`
 	Results     []ExecutionResult `json:"results"`
 	PassedTests int               `json:"passedTests"`
-	Date        time.Time         `json:"date"`
+	// Score is set by the game modes ranking more than the passed tests.
+	Score *int `json:"score,omitempty"`
+	// WallTime and CpuTime are the sums of the times of the tests, in
+	// milliseconds. Runs is how many times the tests were run.
+	WallTime float64   `json:"wallTime"`
+	CpuTime  float64   `json:"cpuTime"`
+	Runs     int       `json:"runs"`
+	Date     time.Time `json:"date"`
 }
 
 type ChallengeId int32
@@ -77,29 +104,73 @@ type TestCase struct {
 	Output string `json:"output"`
 }
 
-func NewLobby(owner *User, allowedLanguages []string) Lobby {
-	return Lobby{
+func NewLobby(owner *User, allowedLanguages []string, timings bool, maxCodeSize int) *Lobby {
+	owner.joinedAt = time.Now()
+	lobby := &Lobby{
 		Id:    uuid.NewString(),
 		Owner: owner,
 		Users: map[UserId]*User{owner.Id: owner},
 		Settings: Settings{
-			MaxPlayers:       8,
-			GameDuration:     time.Minute * 15 / time.Second,
+			Mode:             defaultMode,
+			MaxPlayers:       defaultMaxPlayers,
+			Golf:             GolfSettings{Unit: GolfUnitBytes},
+			Teams:            TeamSettings{Count: defaultTeamCount, Scoring: TeamScoringBest},
+			Rounds:           RoundSettings{Count: 1},
+			Elimination:      EliminationSettings{Schedule: []int{1}},
+			GameDuration:     defaultGameDuration,
 			AllowedLanguages: allowedLanguages,
+			MaxCodeSize:      maxCodeSize,
 		},
-		State: PreLobbyState{
-			Type:  "preLobby",
-			Ready: []UserId{},
-		},
+		State:  NewPreLobbyState(),
+		events: make(chan lobbyEvent, lobbyEventQueueSize),
+		closed: make(chan struct{}),
+		checks: map[UserId]*checkQueue{},
+		teams:  map[UserId]int{},
+
+		languages:   allowedLanguages,
+		timings:     timings,
+		maxCodeSize: maxCodeSize,
+	}
+	// the lobby is not shared yet, the first version is built outside the loop
+	if value, err := lobby.documentValue(); err == nil {
+		lobby.document.value = value
 	}
+	go lobby.run()
+	return lobby
 }
 
-func (lobby *Lobby) CannotJoin(_ *User) error {
-	if _, ok := lobby.State.(PreLobbyState); !ok {
-		return fmt.Errorf("lobby is not in PreLobby")
+// CannotJoin returns a LobbyError if the user is not allowed to join the
+// lobby. Members can always join again while the lobby is waiting.
+// verifiedHash is the password hash verified for the user, see verifyPassword.
+func (lobby *Lobby) CannotJoin(user *User, verifiedHash []byte) error {
+	if _, err := lobby.preLobby("join"); err != nil {
+		return err
+	}
+	if lobby.GetUser(user) != nil {
+		return nil
+	}
+	if err := lobby.checkAccess(user, verifiedHash); err != nil {
+		return err
 	}
 	if len(lobby.Users) >= lobby.Settings.MaxPlayers {
-		return fmt.Errorf("lobby is full")
+		return NewLobbyError(ErrorLobbyFull, "lobby is full")
+	}
+	return nil
+}
+
+// RequireOwner returns a LobbyError if the user is not the owner of the lobby.
+func (lobby *Lobby) RequireOwner(user *User, action string) error {
+	if lobby.Owner.Id != user.Id {
+		return NewLobbyError(ErrorNotOwner, "only the owner can %s", action)
+	}
+	return nil
+}
+
+// checkMember rejects the users that left or were kicked, whose client may
+// still send a few packets before it is closed.
+func (lobby *Lobby) checkMember(user *User) error {
+	if lobby.Users[user.Id] != user {
+		return NewLobbyError(ErrorNotMember, "you are not in the lobby")
 	}
 	return nil
 }
@@ -109,7 +180,7 @@ func (lobby *Lobby) GetUser(user *User) *User {
 }
 
 func (lobby *Lobby) GetReadyUsers() []UserId {
-	if lobbyState, ok := lobby.State.(PreLobbyState); ok {
+	if lobbyState, err := lobby.preLobby("list ready users"); err == nil {
 		return lobbyState.Ready
 	}
 	return []UserId{}
@@ -117,96 +188,361 @@ func (lobby *Lobby) GetReadyUsers() []UserId {
 
 func (lobby *Lobby) AddUser(user *User) {
 	log.Printf("Adding user to lobby: %v\n", user.Username)
+	user.joinedAt = time.Now()
 	lobby.Users[user.Id] = user
+	lobby.reindex()
+	lobby.assignTeams()
+}
+
+func (lobby *Lobby) TransferOwnership(user *User) {
+	log.Printf("Transferring lobby %v to user: %v\n", lobby.Id, user.Username)
+	lobby.Owner = user
+	lobby.reindex()
+	lobby.BroadcastPacket(PacketOutOwnerChanged{
+		Owner: user,
+	})
+}
+
+// nextOwner returns the connected member, other than the owner, that has been
+// in the lobby the longest, or nil if there is none.
+func (lobby *Lobby) nextOwner() *User {
+	var next *User
+	for _, user := range lobby.Users {
+		if user == lobby.Owner || user.Connection == nil {
+			continue
+		}
+		if next == nil || user.joinedAt.Before(next.joinedAt) {
+			next = user
+		}
+	}
+	return next
 }
 
-func (lobby *Lobby) SetSettings(settings Settings) {
+// SetSettings validates the settings and broadcasts them once applied.
+func (lobby *Lobby) SetSettings(settings Settings) error {
+	if _, err := lobby.preLobby("change the settings"); err != nil {
+		return err
+	}
+	settings = settings.normalize()
+	if err := lobby.validateSettings(settings); err != nil {
+		return err
+	}
 	lobby.Settings = settings
+	lobby.BroadcastPacket(PacketOutSettingsUpdated{
+		Settings: settings,
+	})
+	lobby.assignTeams()
+	return nil
 }
 
 func (lobby *Lobby) SetReadyState(user *User, state string) error {
-	if lobbyState, ok := lobby.State.(PreLobbyState); ok {
-		if state == StatusReady {
+	lobbyState, err := lobby.preLobby("change ready state")
+	if err != nil {
+		return err
+	}
+	if state == StatusReady {
+		if !slices.Contains(lobbyState.Ready, user.Id) {
 			lobbyState.Ready = append(lobbyState.Ready, user.Id)
-		} else if state == StatusNotReady {
-			lobbyState.Ready = utils.Remove(lobbyState.Ready, user.Id)
-		} else {
-			return fmt.Errorf("unknown user state: %v", state)
 		}
-		return nil
+	} else if state == StatusNotReady {
+		lobbyState.Ready = utils.Remove(lobbyState.Ready, user.Id)
 	} else {
-		return fmt.Errorf("lobby is not in PreLobby")
+		return NewLobbyError(ErrorInvalidValue, "unknown user state: %v", state)
 	}
+	return nil
 }
 
+// RunTest runs the code against the public test cases of the challenge.
+// The runner is called outside the lobby goroutine.
 func (lobby *Lobby) RunTest(user *User, runner *Runner, language string, code string) (*RunResult, error) {
-	state, ok := lobby.State.(GameLobbyState)
-	if !ok {
-		return nil, fmt.Errorf("lobby is not in game state")
+	var run testRun
+	var round *GameLobbyState
+	err := lobby.Call(func() error {
+		if err := lobby.checkMember(user); err != nil {
+			return err
+		}
+		state, err := lobby.game("run tests")
+		if err != nil {
+			return err
+		}
+		round = state
+		if err := state.checkOpen(); err != nil {
+			return err
+		}
+		if err := state.checkPlaying(user); err != nil {
+			return err
+		}
+		if err := lobby.checkCodeSize(code); err != nil {
+			return err
+		}
+		run = lobby.newTestRun(state, false)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	var input []string
-	for _, testCase := range state.Challenge.TestCases {
-		input = append(input, testCase.Input)
+	runResult, err := run.execute(runner, language, code)
+	if err != nil {
+		return nil, err
+	}
+	err = lobby.Call(func() error {
+		state, err := lobby.game("run tests")
+		if err != nil {
+			return err
+		}
+		// the runner may have been busy until the next round
+		if state != round {
+			return NewLobbyError(ErrorInvalidState, "round %d is over", round.Round)
+		}
+		userState := state.UsersState[user.Id]
+		userState.runs.LastRunResult = runResult
+		state.UsersState[user.Id] = userState
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return runResult, nil
+}
+
+// checkCodeSize rejects code larger than the limit of the lobby.
+func (lobby *Lobby) checkCodeSize(code string) error {
+	limit := lobby.maxCodeSize
+	if lobby.Settings.MaxCodeSize > 0 {
+		limit = min(lobby.Settings.MaxCodeSize, limit)
 	}
-	result, err := runner.Run(language, code, input)
+	if len(code) > limit {
+		return NewLobbyError(ErrorCodeTooLarge, "code is %d bytes, the limit is %d bytes", len(code), limit)
+	}
+	return nil
+}
+
+// Submit runs the code against the hidden test cases of the challenge and
+// stores it as the final submission of the user in the round, which is
+// returned. In the resubmit modes, stored is false when the submission does
+// not replace the one kept.
+func (lobby *Lobby) Submit(user *User, runner *Runner, language string, code string) (result *RunResult, round *GameLobbyState, stored bool, err error) {
+	var run testRun
+	err = lobby.Call(func() error {
+		if err := lobby.checkMember(user); err != nil {
+			return err
+		}
+		state, err := lobby.game("submit")
+		if err != nil {
+			return err
+		}
+		round = state
+		if err := state.checkOpen(); err != nil {
+			return err
+		}
+		if err := state.checkPlaying(user); err != nil {
+			return err
+		}
+		mode := lobby.mode()
+		if _, resubmit := mode.(ResubmitMode); !resubmit && state.UsersState[user.Id].runs.SubmitResult != nil {
+			return NewLobbyError(ErrorAlreadySubmitted, "submit result is already set")
+		}
+		if err := lobby.checkCodeSize(code); err != nil {
+			return err
+		}
+		run = lobby.newTestRun(state, true)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, false, err
+	}
+	runResult, err := run.execute(runner, language, code)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	err = lobby.Call(func() error {
+		state, err := lobby.game("submit")
+		if err != nil {
+			return err
+		}
+		// the runner may have been busy until the next round
+		if state != round {
+			return NewLobbyError(ErrorInvalidState, "round %d is over", round.Round)
+		}
+		userState := state.UsersState[user.Id]
+		if resubmitMode, ok := run.mode.(ResubmitMode); ok {
+			// the result is returned to the user even when it is not the best
+			if userState.runs.SubmitResult == nil || resubmitMode.Better(runResult, userState.runs.SubmitResult) {
+				userState.submit(runResult)
+				state.UsersState[user.Id] = userState
+				stored = true
+			}
+			return nil
+		}
+		// another submission of the same user may have been stored while the runner was busy
+		if userState.runs.SubmitResult != nil {
+			return NewLobbyError(ErrorAlreadySubmitted, "submit result is already set")
+		}
+		userState.submit(runResult)
+		state.UsersState[user.Id] = userState
+		stored = true
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("error while running code: %v", err)
+		return nil, nil, false, err
+	}
+	return runResult, round, stored, nil
+}
+
+// CountSubmit is called once a submission to the round has been registered
+// and its result sent, so that the round never ends before the last result
+// is delivered.
+func (lobby *Lobby) CountSubmit(round *GameLobbyState) {
+	state, err := lobby.game("count submissions")
+	if err != nil || state != round {
+		return
 	}
-	runResult := RunResult{
-		Code:        code,
-		Language:    language,
-		Results:     result,
-		Date:        time.Now(),
-		PassedTests: testsPassed(state.Challenge.TestCases, result),
+	state.SubmitCount++
+	mode := lobby.mode()
+	players := lobby.players(state.Eliminated)
+	if _, ok := mode.(ResubmitMode); ok {
+		lobby.BroadcastPacket(PacketOutLeaderboard{
+			Leaderboard: mode.Leaderboard(players, state),
+		})
 	}
-	state.UsersState[user.Id] = UserGameLobbyState{
-		LastRunResult: &runResult,
-		SubmitResult:  state.UsersState[user.Id].SubmitResult,
+	if err := mode.EndsEarly(players, state); err != nil {
+		state.context(err)
+	}
+}
+
+func (lobby *Lobby) KickUser(userId UserId) error {
+	if userId == lobby.Owner.Id {
+		return NewLobbyError(ErrorInvalidTarget, "the owner cannot be kicked")
+	}
+	if _, ok := lobby.Users[userId]; !ok {
+		return NewLobbyError(ErrorUserNotFound, "user %v is not in the lobby", userId)
+	}
+	state, err := lobby.preLobby("kick users")
+	if err != nil {
+		return err
+	}
+	delete(lobby.Users, userId)
+	state.Ready = utils.Remove(state.Ready, userId)
+	lobby.reindex()
+	lobby.assignTeams()
+	return nil
+}
+
+// reindex refreshes the registry entry of the lobby after its owner, users or
+// state changed.
+func (lobby *Lobby) reindex() {
+	if lobby.registry != nil {
+		lobby.registry.Update(lobby)
 	}
-	return &runResult, nil
 }
 
-func (lobby *Lobby) Submit(user *User, runner *Runner, language string, code string) (*RunResult, error) {
-	state, ok := lobby.State.(GameLobbyState)
-	if !ok {
-		return nil, fmt.Errorf("lobby is not in game state")
+// testRun is what a check or a submission runs, captured from the lobby so
+// that it can execute outside of its goroutine.
+type testRun struct {
+	mode      GameMode
+	settings  Settings
+	testCases []TestCase
+	// runs is how many times the tests are run, the median timing is kept
+	runs int
+}
+
+func (lobby *Lobby) newTestRun(state *GameLobbyState, submit bool) testRun {
+	mode := lobby.mode()
+	run := testRun{
+		mode:      mode,
+		settings:  lobby.Settings,
+		testCases: mode.TestCases(state.Challenge, submit),
+		runs:      1,
 	}
-	if state.UsersState[user.Id].SubmitResult != nil {
-		return nil, fmt.Errorf("submit result is already set")
+	if repeated, ok := mode.(RepeatedMode); ok {
+		run.runs = max(repeated.Runs(submit), 1)
 	}
+	return run
+}
+
+func (run testRun) execute(runner *Runner, language string, code string) (*RunResult, error) {
 	var input []string
-	for _, testCase := range state.Challenge.HiddenTestCases {
+	for _, testCase := range run.testCases {
 		input = append(input, testCase.Input)
 	}
-	result, err := runner.Run(language, code, input)
-	if err != nil {
-		return nil, fmt.Errorf("error while running code: %v", err)
+	runs := make([][]ExecutionResult, 0, run.runs)
+	for i := 0; i < run.runs; i++ {
+		result, err := runner.Run(language, code, input)
+		if err != nil {
+			return nil, fmt.Errorf("error while running code: %v", err)
+		}
+		if _, repeated := run.mode.(RepeatedMode); repeated && !hasTimings(result) {
+			return nil, fmt.Errorf("the runner did not report the time of the tests")
+		}
+		runs = append(runs, result)
 	}
-	runResult := RunResult{
-		Code:        code,
-		Language:    language,
-		Results:     result,
-		Date:        time.Now(),
-		PassedTests: testsPassed(state.Challenge.HiddenTestCases, result),
+	results := medianTimings(runs)
+	runResult := &RunResult{
+		Code:     code,
+		Language: language,
+		Results:  results,
+		Runs:     run.runs,
+		Date:     time.Now(),
 	}
-	state.UsersState[user.Id] = UserGameLobbyState{
-		LastRunResult: state.UsersState[user.Id].LastRunResult,
-		SubmitResult:  &runResult,
+	for _, result := range results {
+		if result.WallTime != nil {
+			runResult.WallTime += *result.WallTime
+		}
+		if result.CpuTime != nil {
+			runResult.CpuTime += *result.CpuTime
+		}
 	}
-	state.SubmitCount++
-	if state.SubmitCount == len(lobby.Users) {
-		state.context(fmt.Errorf("all users submitted"))
+	run.mode.Score(run.settings, run.testCases, runResult)
+	return runResult, nil
+}
+
+// hasTimings reports whether the runner timed every test. A fast test may
+// take 0ms on a coarse clock, only a missing time counts.
+func hasTimings(results []ExecutionResult) bool {
+	for _, result := range results {
+		if result.WallTime == nil || result.CpuTime == nil {
+			return false
+		}
 	}
-	return &runResult, nil
+	return true
 }
 
-func (lobby *Lobby) KickUser(userId UserId) error {
-	if _, ok := lobby.State.(PreLobbyState); ok {
-		delete(lobby.Users, userId)
-		return nil
+// medianTimings returns the results of the first run, with the timing of
+// each test replaced by its median over the runs that timed it.
+func medianTimings(runs [][]ExecutionResult) []ExecutionResult {
+	results := slices.Clone(runs[0])
+	for i := range results {
+		wallTimes := make([]float64, 0, len(runs))
+		cpuTimes := make([]float64, 0, len(runs))
+		for _, run := range runs {
+			if i >= len(run) {
+				continue
+			}
+			if run[i].WallTime != nil {
+				wallTimes = append(wallTimes, *run[i].WallTime)
+			}
+			if run[i].CpuTime != nil {
+				cpuTimes = append(cpuTimes, *run[i].CpuTime)
+			}
+		}
+		results[i].WallTime = median(wallTimes)
+		results[i].CpuTime = median(cpuTimes)
 	}
+	return results
+}
 
-	return fmt.Errorf("lobby is not in PreLobby")
+// median returns nil when there are no values.
+func median(values []float64) *float64 {
+	if len(values) == 0 {
+		return nil
+	}
+	slices.Sort(values)
+	middle := len(values) / 2
+	result := values[middle]
+	if len(values)%2 == 0 {
+		result = (values[middle-1] + values[middle]) / 2
+	}
+	return &result
 }
 
 func testsPassed(testCases []TestCase, results []ExecutionResult) int {
@@ -219,67 +555,243 @@ func testsPassed(testCases []TestCase, results []ExecutionResult) int {
 	return passed
 }
 
-func GetStateType(state any) string {
-	switch state.(type) {
-	case PreLobbyState:
-		return "preLobby"
-	case GameLobbyState:
-		return "game"
-	default:
-		return "unknown"
-	}
-}
-
+// StartLobby fetches a random challenge and starts the countdown before the
+// game.
 func (s *APIServer) StartLobby(lobby *Lobby, ctx context.Context) error {
-	if _, ok := lobby.State.(PreLobbyState); !ok {
-		return fmt.Errorf("lobby is not in PreLobby")
+	if s.draining.Load() {
+		return ErrShuttingDown
+	}
+	err := lobby.Call(func() error {
+		_, err := lobby.preLobby("start")
+		return err
+	})
+	if err != nil {
+		return err
 	}
-	ctx, cancel := context.WithCancelCause(ctx)
 
 	randomChallenge, err := s.Backend.GetRandomChallenge()
 	if err != nil {
 		return fmt.Errorf("error while getting random challenge: %v", err)
 	}
 
-	lobby.State = GameLobbyState{
-		Type:        "game",
-		Challenge:   *randomChallenge,
-		StartTime:   time.Now(),
-		UsersState:  map[UserId]UserGameLobbyState{},
-		SubmitCount: 0,
-		context:     cancel,
+	ctx, cancel := context.WithCancelCause(ctx)
+	countdown := &CountdownLobbyState{
+		Type:      StateCountdown,
+		StartTime: time.Now().Add(s.Config.Countdown),
+		challenge: *randomChallenge,
+		context:   cancel,
 	}
-	go s.HandleGame(lobby, ctx)
+	err = lobby.Call(func() error {
+		s.starting.Lock()
+		defer s.starting.Unlock()
+		// the server may have started draining while fetching the challenge
+		if s.draining.Load() {
+			return ErrShuttingDown
+		}
+		// the lobby may have been started or deleted while fetching the challenge
+		if err := lobby.SetState(countdown); err != nil {
+			return err
+		}
+		s.games.Add(1)
+		lobby.BroadcastPacket(PacketOutCountdown{
+			StartTime: countdown.StartTime,
+		})
+		return nil
+	})
+	if err != nil {
+		cancel(err)
+		return err
+	}
+	go lobby.runTimer(ctx, StateCountdown, countdown.StartTime, countdownTimerInterval)
+	go s.HandleGame(lobby, ctx, countdown)
 	return nil
 }
 
-func (s *APIServer) HandleGame(lobby *Lobby, ctx context.Context) {
-	state := lobby.State.(GameLobbyState)
-	lobby.BroadcastPacket(PacketOutGameStarted{
-		state.StartTime,
-		state.Challenge,
+// HandleGame drives the lobby from the end of the countdown to its closing,
+// playing every round of the match.
+func (s *APIServer) HandleGame(lobby *Lobby, ctx context.Context, countdown *CountdownLobbyState) {
+	defer s.games.Done()
+	utils.WaitUntil(ctx, countdown.StartTime)
+	if ctx.Err() != nil {
+		// the game was never registered with the backend, nothing to finalize
+		log.Printf("countdown of lobby %v interrupted: %v\n", lobby.Id, context.Cause(ctx))
+		s.Lobbies.Remove(lobby.Id)
+		_ = lobby.Post(lobby.Close)
+		return
+	}
+	var last roundResult
+	var scoreboard []ScoreboardEntry
+	var eliminated map[UserId]int
+	challenge := &countdown.challenge
+	for round := 1; ; round++ {
+		state, roundCtx, err := s.startRound(lobby, ctx, countdown.context, round, *challenge, eliminated)
+		if err != nil {
+			log.Printf("error while starting round %d: %v\n", round, err)
+			if round == 1 {
+				// as for an interrupted countdown, nothing to finalize
+				s.Lobbies.Remove(lobby.Id)
+				_ = lobby.Post(lobby.Close)
+				return
+			}
+			break
+		}
+		utils.WaitUntil(roundCtx, state.Deadline)
+		var intermission *IntermissionLobbyState
+		err = lobby.Call(func() error {
+			state, err := lobby.game("end the round")
+			if err != nil {
+				return err
+			}
+			last = lobby.roundResults(state)
+			eliminated = lobby.eliminate(state, last.leaderboard)
+			scoreboard = addRound(scoreboard, last.leaderboard, lobby.Settings.Rounds.BestOf, eliminated)
+			if round == state.Rounds || ctx.Err() != nil || lobby.matchOver(scoreboard, state, eliminated) {
+				return nil
+			}
+			intermission = &IntermissionLobbyState{
+				Type:        StateIntermission,
+				Round:       round,
+				Rounds:      state.Rounds,
+				Leaderboard: last.leaderboard,
+				Teams:       last.teams,
+				Scoreboard:  scoreboard,
+				NextRoundAt: time.Now().Add(s.Config.Intermission),
+				eliminated:  eliminated,
+				match:       state.match,
+			}
+			if err := lobby.SetState(intermission); err != nil {
+				return err
+			}
+			lobby.BroadcastPacket(PacketOutRoundEnded{
+				Round:       intermission.Round,
+				Leaderboard: intermission.Leaderboard,
+				Teams:       intermission.Teams,
+				Scoreboard:  intermission.Scoreboard,
+				NextRoundAt: intermission.NextRoundAt,
+			})
+			return nil
+		})
+		state.context(nil)
+		if err != nil {
+			log.Printf("error while ending round %d: %v\n", round, err)
+		}
+		if err := s.Backend.EndLobby(state.GameId); err != nil {
+			log.Printf("error while ending lobby: %v\n", err)
+		}
+		if intermission == nil {
+			break
+		}
+		go lobby.runTimer(ctx, StateIntermission, intermission.NextRoundAt, countdownTimerInterval)
+		// the challenge of the next round is fetched during the intermission
+		challenge, err = s.Backend.GetRandomChallenge()
+		if err != nil {
+			log.Printf("error while getting random challenge, ending the match: %v\n", err)
+			break
+		}
+		utils.WaitUntil(ctx, intermission.NextRoundAt)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	var results *ResultsLobbyState
+	err := lobby.Call(func() error {
+		if last.game == nil {
+			return fmt.Errorf("no round was played")
+		}
+		results = &ResultsLobbyState{
+			Type:        StateResults,
+			Game:        last.game,
+			Leaderboard: last.leaderboard,
+			Teams:       last.teams,
+			ClosesAt:    time.Now().Add(s.Config.ResultsWindow),
+		}
+		if last.game.Rounds > 1 {
+			results.Scoreboard = scoreboard
+		}
+		if err := lobby.SetState(results); err != nil {
+			return err
+		}
+		lobby.BroadcastPacket(PacketOutGameEnded{
+			Leaderboard: results.Leaderboard,
+			Teams:       results.Teams,
+			Scoreboard:  results.Scoreboard,
+			ClosesAt:    results.ClosesAt,
+		})
+		return nil
 	})
-	err := s.Backend.CreateLobby(lobby)
 	if err != nil {
-		_ = fmt.Errorf("error while creating lobby: %v", err)
+		log.Printf("error while ending game: %v\n", err)
 	}
-	utils.WaitUntil(ctx, state.StartTime.Add(lobby.Settings.GameDuration))
-	delete(s.Lobbies, lobby.Id)
-	err = s.Backend.EndLobby(lobby)
+	// the lobby stays readable for the results window, so that users
+	// reconnecting late still see the outcome
+	if results != nil {
+		utils.WaitUntil(s.closing, results.ClosesAt)
+	}
+	s.Lobbies.Remove(lobby.Id)
+	_ = lobby.Post(lobby.Close)
+}
+
+// startRound moves the lobby to the round, played by the users that are not
+// eliminated, and registers it with the backend. The returned context ends
+// with the round.
+func (s *APIServer) startRound(lobby *Lobby, ctx context.Context, match context.CancelCauseFunc, round int, challenge Challenge, eliminated map[UserId]int) (*GameLobbyState, context.Context, error) {
+	roundCtx, cancel := context.WithCancelCause(ctx)
+	var state *GameLobbyState
+	var game map[string]any
+	err := lobby.Call(func() error {
+		startTime := time.Now()
+		state = &GameLobbyState{
+			Type:        StateGame,
+			Round:       round,
+			Rounds:      lobby.rounds(round, eliminated),
+			GameId:      lobby.Id,
+			Challenge:   challenge,
+			StartTime:   startTime,
+			Deadline:    startTime.Add(lobby.Settings.GameDuration),
+			UsersState:  map[UserId]UserGameLobbyState{},
+			SubmitCount: 0,
+			Eliminated:  eliminated,
+			context:     cancel,
+			match:       match,
+		}
+		// the first round keeps the id of the lobby, as single games always did
+		if round > 1 {
+			state.GameId = uuid.NewString()
+		}
+		if err := lobby.SetState(state); err != nil {
+			return err
+		}
+		lobby.BroadcastPacket(PacketOutGameStarted{
+			Round:     state.Round,
+			Rounds:    state.Rounds,
+			StartTime: state.StartTime,
+			Deadline:  state.Deadline,
+			Challenge: state.Challenge,
+		})
+		game = lobby.gameRecord(state)
+		return nil
+	})
 	if err != nil {
-		_ = fmt.Errorf("error while ending lobby: %v", err)
+		cancel(err)
+		return nil, nil, err
+	}
+	go lobby.runTimer(roundCtx, StateGame, state.Deadline, gameTimerInterval)
+	if err := s.Backend.CreateLobby(game); err != nil {
+		log.Printf("error while creating lobby: %v\n", err)
 	}
+	return state, roundCtx, nil
 }
 
 func (s *APIServer) DeleteLobby(lobby *Lobby, ctx context.Context) error {
-	if _, ok := lobby.State.(PreLobbyState); !ok {
-		return fmt.Errorf("lobby is not in PreLobby")
+	if _, err := lobby.preLobby("delete the lobby"); err != nil {
+		return err
 	}
 
 	lobby.BroadcastPacket(PacketOutLobbyDelete{
 		Deleted: true,
 	})
 
-	delete(s.Lobbies, lobby.Id)
+	s.Lobbies.Remove(lobby.Id)
+	lobby.Close()
 	return nil
 }
@@ -0,0 +1,29 @@
+package codeduel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOwnerMigration(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	server.Config.PresenceGracePeriod = 100 * time.Millisecond
+	owner, id := createLobby(t, httpServer, "u1")
+	second := joinLobby(t, httpServer, id, "u2")
+	third := joinLobby(t, httpServer, id, "u3")
+
+	// the oldest member takes over when the owner leaves
+	_ = owner.Close()
+	if changed := third.until("ownerChanged"); changed["owner"].(map[string]any)["id"] != 2.0 {
+		t.Fatal(changed)
+	}
+
+	third.send(map[string]any{"type": "transferOwnership", "userId": 2})
+	if err := third.until("error"); err["code"] != "not_owner" {
+		t.Fatal(err)
+	}
+	second.send(map[string]any{"type": "transferOwnership", "userId": 3})
+	if changed := third.until("ownerChanged"); changed["owner"].(map[string]any)["id"] != 3.0 {
+		t.Fatal(changed)
+	}
+}
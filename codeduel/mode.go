@@ -0,0 +1,105 @@
+package codeduel
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const defaultMode = "classic"
+
+// GameMode owns the rules of a game: the tests run by check and submit, how
+// a run is scored, when the game ends and how the users are ranked.
+// The methods are called from inside lobby events, except Score.
+type GameMode interface {
+	// Name is the value of Settings.Mode selecting the mode.
+	Name() string
+	// Id is the id of the mode in the backend.
+	Id() int
+	// TestCases returns the tests run by check, or by submit when submit is true.
+	TestCases(challenge Challenge, submit bool) []TestCase
+	// Score fills the score of a run, it is called outside lobby events
+	// with the settings of the lobby when the run started.
+	Score(settings Settings, testCases []TestCase, result *RunResult)
+	// EndsEarly returns why the game ends before its deadline, nil while
+	// it goes on.
+	EndsEarly(users map[UserId]*User, state *GameLobbyState) error
+	// Leaderboard ranks the users once the game ended.
+	Leaderboard(users map[UserId]*User, state *GameLobbyState) []LeaderboardEntry
+}
+
+// ResubmitMode is implemented by the modes where users submit as many times
+// as they want during the game. The best submission of each user is kept
+// and the leaderboard is broadcast after every submission.
+type ResubmitMode interface {
+	GameMode
+	// Better reports whether result replaces previous as the submission of
+	// the user.
+	Better(result *RunResult, previous *RunResult) bool
+}
+
+// RepeatedMode is implemented by the modes running the tests more than
+// once, to take the median of their timing.
+type RepeatedMode interface {
+	GameMode
+	// Runs returns how many times the tests of check, or of submit when
+	// submit is true, are run.
+	Runs(submit bool) int
+}
+
+var gameModes = map[string]GameMode{
+	ClassicMode{}.Name():     ClassicMode{},
+	GolfMode{}.Name():        GolfMode{},
+	PerformanceMode{}.Name(): PerformanceMode{},
+	TeamMode{}.Name():        TeamMode{},
+	EliminationMode{}.Name(): EliminationMode{},
+}
+
+// gameModeNames lists the registered modes, for error messages.
+func gameModeNames() string {
+	names := make([]string, 0, len(gameModes))
+	for name := range gameModes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return strings.Join(names, ", ")
+}
+
+// mode returns the game mode selected in the settings. The settings are
+// validated, so the mode is always registered.
+func (lobby *Lobby) mode() GameMode {
+	if mode, ok := gameModes[lobby.Settings.Mode]; ok {
+		return mode
+	}
+	return gameModes[defaultMode]
+}
+
+// ClassicMode ranks the users by the hidden tests they pass, then by how
+// fast they submitted. The game ends when everyone submitted.
+type ClassicMode struct{}
+
+func (ClassicMode) Name() string { return "classic" }
+
+func (ClassicMode) Id() int { return 1 }
+
+func (ClassicMode) TestCases(challenge Challenge, submit bool) []TestCase {
+	if submit {
+		return challenge.HiddenTestCases
+	}
+	return challenge.TestCases
+}
+
+func (ClassicMode) Score(_ Settings, testCases []TestCase, result *RunResult) {
+	result.PassedTests = testsPassed(testCases, result.Results)
+}
+
+func (ClassicMode) EndsEarly(users map[UserId]*User, state *GameLobbyState) error {
+	if state.SubmitCount >= len(users) {
+		return fmt.Errorf("all users submitted")
+	}
+	return nil
+}
+
+func (ClassicMode) Leaderboard(users map[UserId]*User, state *GameLobbyState) []LeaderboardEntry {
+	return BuildLeaderboard(users, state)
+}
@@ -0,0 +1,23 @@
+package codeduel
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGameModeSetting(t *testing.T) {
+	_, server := newTestServer(t)
+	owner := dialLobby(t, server, "/create", "u1")
+	if mode := owner.until("lobby")["settings"].(map[string]any)["mode"]; mode != "classic" {
+		t.Fatal(mode)
+	}
+	owner.send(map[string]any{"type": "updateSettings", "settings": map[string]any{"mode": "nope", "maxPlayers": 4, "gameDuration": 60, "allowedLanguages": []string{"go"}}})
+	// the error lists the modes to pick from
+	if err := owner.until("error"); err["code"] != "invalid_value" || !strings.Contains(err["message"].(string), "classic") {
+		t.Fatal(err)
+	}
+	owner.send(map[string]any{"type": "updateSettings", "settings": map[string]any{"maxPlayers": 4, "gameDuration": 60, "allowedLanguages": []string{"go"}}})
+	if mode := owner.until("settingsUpdated")["settings"].(map[string]any)["mode"]; mode != "classic" {
+		t.Fatal(mode)
+	}
+}
@@ -1,108 +1,192 @@
 package codeduel
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
 	"time"
-
-	"github.com/gorilla/websocket"
 )
 
-func UnmarshalPacket(message []byte, packet *any) error {
-	var packetType struct {
-		Type string `json:"type"`
+//go:generate go run ../cmd/packetgen -out ../schema
+
+// InboundPackets are the packets sent by the clients. Their fields are
+// optional, but the ones present are validated against the schema.
+var InboundPackets = NewPacketRegistry("InboundPacket", struct {
+	RequestId string `json:"requestId,omitempty"`
+}{}, false)
+
+// OutboundPackets are the packets sent by the server, every one of them
+// carries the lobby sequence number.
+var OutboundPackets = NewPacketRegistry("OutboundPacket", outboundFields{}, true)
+
+type outboundFields = struct {
+	Seq uint64 `json:"seq"`
+}
+
+func init() {
+	InboundPackets.Register("updateSettings", PacketInSettings{})
+	InboundPackets.Register("updatePlayerStatus", PacketInUserStatus{})
+	InboundPackets.Register("start", PacketInStartLobby{})
+	InboundPackets.Register("check", PacketInCheck{})
+	InboundPackets.Register("submit", PacketInSubmit{})
+	InboundPackets.Register("lock", PacketInLock{})
+	InboundPackets.Register("setPassword", PacketInSetPassword{})
+	InboundPackets.Register("setInvites", PacketInSetInvites{})
+	InboundPackets.Register("joinTeam", PacketInJoinTeam{})
+	InboundPackets.Register("balanceTeams", PacketInBalanceTeams{})
+	InboundPackets.Register("delete", PacketInDelete{})
+	InboundPackets.Register("ready", PacketInReady{})
+	InboundPackets.Register("kick", PacketInKick{})
+	InboundPackets.Register("transferOwnership", PacketInTransferOwnership{})
+	InboundPackets.Register("resync", PacketInResync{})
+	InboundPackets.Register("timeSync", PacketInTimeSync{})
+
+	OutboundPackets.Register("lobby", PacketOutLobby{})
+	OutboundPackets.Register("gameStarted", PacketOutGameStarted{})
+	OutboundPackets.Register("checkResult", PacketOutCheckResult{})
+	OutboundPackets.Register("submitResult", PacketOutSubmitResult{})
+	OutboundPackets.Register("usersUpdate", PacketOutUsersUpdate{})
+	OutboundPackets.Register("lobbyDelete", PacketOutLobbyDelete{})
+	OutboundPackets.Register("presence", PacketOutPresence{})
+	OutboundPackets.Register("ownerChanged", PacketOutOwnerChanged{})
+	OutboundPackets.Register("countdown", PacketOutCountdown{})
+	OutboundPackets.Register("gameEnded", PacketOutGameEnded{})
+	OutboundPackets.Register("error", PacketOutError{})
+	OutboundPackets.Register("lobbyPatch", PacketOutLobbyPatch{})
+	OutboundPackets.Register("timeSync", PacketOutTimeSync{})
+	OutboundPackets.Register("timer", PacketOutTimer{})
+	OutboundPackets.Register("settingsUpdated", PacketOutSettingsUpdated{})
+	OutboundPackets.Register("accessUpdated", PacketOutAccessUpdated{})
+	OutboundPackets.Register("leaderboard", PacketOutLeaderboard{})
+	OutboundPackets.Register("teamsUpdated", PacketOutTeamsUpdated{})
+	OutboundPackets.Register("roundEnded", PacketOutRoundEnded{})
+	OutboundPackets.Register("playersEliminated", PacketOutPlayersEliminated{})
+}
+
+// PacketHeader holds the fields shared by every inbound packet. RequestId is
+// optional, when set it is echoed in every direct reply to the packet.
+type PacketHeader struct {
+	Type      string          `json:"type"`
+	RequestId string          `json:"requestId,omitempty"`
+	Protocol  ProtocolVersion `json:"-"`
+	// ReceivedAt is when the message was read from the connection.
+	ReceivedAt time.Time `json:"-"`
+}
+
+// UnmarshalPacket decodes an inbound message and returns its header.
+// Messages that cannot be decoded return a *PacketError.
+func UnmarshalPacket(codec Codec, message []byte, packet *any) (PacketHeader, error) {
+	var header PacketHeader
+
+	if err := codec.Unmarshal(message, &header); err != nil {
+		return header, &PacketError{Code: ErrorMalformedPacket, Err: err}
 	}
 
-	if err := json.Unmarshal(message, &packetType); err != nil {
-		return err
+	typedPacket, ok := InboundPackets.New(header.Type)
+	if !ok {
+		return header, &PacketError{
+			Code:       ErrorUnknownPacket,
+			PacketType: header.Type,
+			Err:        fmt.Errorf("unknown message type: %s", header.Type),
+		}
 	}
 
-	var typedPacket any
-	switch packetType.Type {
-	case "updateSettings":
-		typedPacket = new(PacketInSettings)
-	case "updatePlayerStatus":
-		typedPacket = new(PacketInUserStatus)
-	case "start":
-		typedPacket = new(PacketInStartLobby)
-	case "check":
-		typedPacket = new(PacketInCheck)
-	case "submit":
-		typedPacket = new(PacketInSubmit)
-	case "lock":
-		typedPacket = new(PacketInLock)
-	case "delete":
-		typedPacket = new(PacketInDelete)
-	case "ready":
-		typedPacket = new(PacketInReady)
-	case "kick":
-		typedPacket = new(PacketInKick)
-	default:
-		return fmt.Errorf("unknown message type: %s", packetType.Type)
+	var raw any
+	if err := codec.Unmarshal(message, &raw); err != nil {
+		return header, &PacketError{Code: ErrorMalformedPacket, PacketType: header.Type, Err: err}
+	}
+	if err := InboundPackets.Validate(header.Type, raw); err != nil {
+		return header, &PacketError{Code: ErrorMalformedPacket, PacketType: header.Type, Err: err}
 	}
 
-	if err := json.Unmarshal(message, &typedPacket); err != nil {
-		return err
+	if err := codec.Unmarshal(message, typedPacket); err != nil {
+		return header, &PacketError{Code: ErrorMalformedPacket, PacketType: header.Type, Err: err}
 	}
 
 	*packet = typedPacket
 
-	return nil
-}
-
-func MarshalPacket(packet any) (any, error) {
-	var packetType string
-	switch packet.(type) {
-	case PacketOutLobby:
-		packetType = "lobby"
-	case PacketOutGameStarted:
-		packetType = "gameStarted"
-	case PacketOutCheckResult:
-		packetType = "checkResult"
-	case PacketOutSubmitResult:
-		packetType = "submitResult"
-	case PacketOutUsersUpdate:
-		packetType = "usersUpdate"
-	case PacketOutLobbyDelete:
-		packetType = "lobbyDelete"
-	default:
-		return nil, fmt.Errorf("unknown packet: %T", packet)
-	}
-	var m map[string]any
-	p, err := json.Marshal(packet)
-	if err != nil {
-		return nil, err
-	}
-	err = json.Unmarshal(p, &m)
+	return header, nil
+}
+
+// ReadPacket blocks until the next message and returns its header. A
+// *PacketError means the message was invalid but the connection is usable.
+func (client *Client) ReadPacket(packet *any) (PacketHeader, error) {
+	_, bytes, err := client.connection.ReadMessage()
 	if err != nil {
-		return nil, err
+		return PacketHeader{Protocol: client.Protocol}, err
 	}
-	m["type"] = packetType
-	return m, nil
+	receivedAt := time.Now()
+	header, err := UnmarshalPacket(client.Codec, bytes, packet)
+	header.Protocol = client.Protocol
+	header.ReceivedAt = receivedAt
+	return header, err
 }
 
-func ReadPacket(connection *websocket.Conn, packet *any) error {
-	_, bytes, err := connection.ReadMessage()
-	if err != nil {
+func (client *Client) sendMessage(message *outboundMessage) error {
+	if client == nil {
+		return fmt.Errorf("client is not connected")
+	}
+	bytes, err := message.encode(client.Protocol, client.Codec)
+	if err != nil || bytes == nil {
 		return err
 	}
-	return UnmarshalPacket(bytes, packet)
+	item := queuedMessage{bytes: bytes}
+	if coalescable(message.packet) {
+		item.message = message
+	}
+	return client.enqueue(item)
 }
 
-func SendPacket(connection *websocket.Conn, packet any) error {
-	packet, err := MarshalPacket(packet)
-	if err != nil {
-		return err
+// outboundMessage is a packet with its sequence number. Its encodings are
+// cached, so that a broadcast is encoded once per wire format instead of
+// once per connection.
+type outboundMessage struct {
+	packet  any
+	seq     uint64
+	encoded map[wireFormat][]byte
+}
+
+type wireFormat struct {
+	version ProtocolVersion
+	codec   string
+}
+
+func (message *outboundMessage) encode(version ProtocolVersion, codec Codec) ([]byte, error) {
+	if bytes, ok := message.cached(version, codec); ok {
+		return bytes, nil
 	}
-	return connection.WriteJSON(packet)
+	format := wireFormat{version: version, codec: codec.Name()}
+	var bytes []byte
+	if packet := packetEncoders[version](message.packet); packet != nil {
+		envelope, err := OutboundPackets.Wrap(packet, outboundFields{Seq: message.seq})
+		if err != nil {
+			return nil, err
+		}
+		if bytes, err = codec.Marshal(envelope); err != nil {
+			return nil, err
+		}
+	}
+	if message.encoded == nil {
+		message.encoded = map[wireFormat][]byte{}
+	}
+	message.encoded[format] = bytes
+	return bytes, nil
 }
 
+// cached returns the encoding of the message in the wire format, if it was
+// already encoded in it.
+func (message *outboundMessage) cached(version ProtocolVersion, codec Codec) ([]byte, bool) {
+	bytes, ok := message.encoded[wireFormat{version: version, codec: codec.Name()}]
+	return bytes, ok
+}
+
+// BroadcastPacket sequences the packet once and sends it to every connected
+// user, returning the users that did not receive it.
 func (lobby *Lobby) BroadcastPacket(packet any) []User {
+	sequenced := lobby.replay.push(nil, packet)
 	users := make([]User, 0, len(lobby.Users))
 	for _, user := range lobby.Users {
 		if user.Connection != nil {
-			err := SendPacket(user.Connection, packet)
+			err := user.Connection.sendMessage(sequenced)
 			if err != nil {
 				log.Printf("error while sending packet to user %v: %v\n", user.Username, err)
 				users = append(users, *user)
@@ -120,7 +204,7 @@ const (
 )
 
 type PacketInSettings struct {
-	Settings Settings
+	Settings Settings `json:"settings"`
 }
 
 type PacketInUserStatus struct {
@@ -145,37 +229,161 @@ type PacketInLock struct {
 	Lock bool `json:"lock"`
 }
 
+// PacketInSetPassword sets the password asked to join the lobby, an empty
+// password removes it.
+type PacketInSetPassword struct {
+	Password string `json:"password"`
+}
+
+// PacketInSetInvites switches the lobby to or from invite-only, UserIds
+// replaces the users allowed to join.
+type PacketInSetInvites struct {
+	InviteOnly bool     `json:"inviteOnly"`
+	UserIds    []UserId `json:"userIds"`
+}
+
 type PacketInDelete struct {
 	Delete bool `json:"delete"`
 }
 type PacketInReady struct {
 	Ready bool `json:"ready"`
 }
+type PacketInJoinTeam struct {
+	Team int `json:"team"`
+}
+
+// PacketInBalanceTeams spreads the users evenly between the teams.
+type PacketInBalanceTeams struct{}
+
 type PacketInKick struct {
 	UserId UserId `json:"userId"`
 }
+type PacketInTransferOwnership struct {
+	UserId UserId `json:"userId"`
+}
+
+// PacketInResync asks for the full lobby, when a patch does not follow the
+// version of the lobby known by the client.
+type PacketInResync struct{}
 
+// PacketInTimeSync asks for the clock of the server. ClientTime is the
+// clock of the client when sending, in milliseconds since the epoch.
+type PacketInTimeSync struct {
+	ClientTime int64 `json:"clientTime"`
+}
+
+// PacketOutLobby is the full lobby at a document version. The patches that
+// follow apply to it in order, starting from Version+1.
 type PacketOutLobby struct {
-	LobbyID  string           `json:"id"`
-	Settings Settings         `json:"settings"`
-	Owner    *User            `json:"owner"`
-	Users    map[UserId]*User `json:"users"`
-	State    any              `json:"state"`
+	RequestId string           `json:"requestId,omitempty"`
+	Version   uint64           `json:"version"`
+	LobbyID   string           `json:"id"`
+	Settings  Settings         `json:"settings"`
+	Access    LobbyAccess      `json:"access"`
+	Owner     *User            `json:"owner"`
+	Users     map[UserId]*User `json:"users"`
+	Teams     map[UserId]int   `json:"teams"`
+	State     LobbyState       `json:"state"`
+	// Runs are the runs of the receiving user in the round, they are not
+	// part of the document.
+	Runs *UserRuns `json:"runs,omitempty"`
+}
+
+// PacketOutLobbyPatch turns the lobby at Base into Version. Base is
+// Version-1 unless the patches queued for a slow client were merged.
+type PacketOutLobbyPatch struct {
+	Base    uint64           `json:"base"`
+	Version uint64           `json:"version"`
+	Patch   []PatchOperation `json:"patch"`
+}
+
+type PacketOutSettingsUpdated struct {
+	Settings Settings `json:"settings"`
+}
+
+type PacketOutAccessUpdated struct {
+	Access LobbyAccess `json:"access"`
+}
+
+// PacketOutTeamsUpdated maps the users to their team, it is empty when
+// the lobby is not playing in teams.
+type PacketOutTeamsUpdated struct {
+	Teams map[UserId]int `json:"teams"`
+}
+
+type PacketOutCountdown struct {
+	StartTime time.Time `json:"startTime"`
 }
 
 type PacketOutGameStarted struct {
+	Round     int       `json:"round"`
+	Rounds    int       `json:"rounds"`
 	StartTime time.Time `json:"startTime"`
+	Deadline  time.Time `json:"deadline"`
 	Challenge Challenge `json:"challenge"`
 }
 
+// PacketOutTimeSync answers PacketInTimeSync. Times are in milliseconds
+// since the epoch, ClientTime is echoed from the request.
+type PacketOutTimeSync struct {
+	RequestId         string `json:"requestId,omitempty"`
+	ClientTime        int64  `json:"clientTime"`
+	ServerReceiveTime int64  `json:"serverReceiveTime"`
+	ServerSendTime    int64  `json:"serverSendTime"`
+}
+
+// PacketOutTimer is sent periodically during the countdown and the game
+// with the time left before the deadline of the phase. Remaining is in
+// milliseconds and ServerTime in milliseconds since the epoch.
+type PacketOutTimer struct {
+	Phase      string    `json:"phase"`
+	Deadline   time.Time `json:"deadline"`
+	Remaining  int64     `json:"remaining"`
+	ServerTime int64     `json:"serverTime"`
+}
+
+// PacketOutLeaderboard is the standing during the game, in the modes where
+// users can submit again.
+type PacketOutLeaderboard struct {
+	Leaderboard []LeaderboardEntry `json:"leaderboard"`
+}
+
+type PacketOutGameEnded struct {
+	Leaderboard []LeaderboardEntry `json:"leaderboard"`
+	Teams       []TeamEntry        `json:"teams,omitempty"`
+	Scoreboard  []ScoreboardEntry  `json:"scoreboard,omitempty"`
+	ClosesAt    time.Time          `json:"closesAt"`
+}
+
+// PacketOutRoundEnded is sent at the end of every round of a match but the
+// last one, which ends with PacketOutGameEnded.
+type PacketOutRoundEnded struct {
+	Round       int                `json:"round"`
+	Leaderboard []LeaderboardEntry `json:"leaderboard"`
+	Teams       []TeamEntry        `json:"teams,omitempty"`
+	Scoreboard  []ScoreboardEntry  `json:"scoreboard"`
+	NextRoundAt time.Time          `json:"nextRoundAt"`
+}
+
+// PacketOutPlayersEliminated is sent after every round of the elimination
+// mode, before the round ends. The match is won by the last player
+// remaining, or by the players remaining after a round eliminating nobody.
+type PacketOutPlayersEliminated struct {
+	Round      int      `json:"round"`
+	Eliminated []UserId `json:"eliminated"`
+	Remaining  []UserId `json:"remaining"`
+}
+
 type PacketOutCheckResult struct {
-	Error  *string           `json:"error"`
-	Result []ExecutionResult `json:"result"`
+	RequestId string            `json:"requestId,omitempty"`
+	Error     *string           `json:"error"`
+	Result    []ExecutionResult `json:"result"`
 }
 
 type PacketOutSubmitResult struct {
-	Error  *string           `json:"error"`
-	Result []ExecutionResult `json:"result"`
+	RequestId string            `json:"requestId,omitempty"`
+	Error     *string           `json:"error"`
+	Result    []ExecutionResult `json:"result"`
 }
 
 type PacketOutUsersUpdate struct {
@@ -186,3 +394,19 @@ type PacketOutUsersUpdate struct {
 type PacketOutLobbyDelete struct {
 	Deleted bool `json:"deleted"`
 }
+
+type PacketOutPresence struct {
+	UserId   UserId `json:"userId"`
+	Presence string `json:"presence"`
+}
+
+type PacketOutOwnerChanged struct {
+	Owner *User `json:"owner"`
+}
+
+type PacketOutError struct {
+	RequestId  string    `json:"requestId,omitempty"`
+	Code       ErrorCode `json:"code"`
+	Message    string    `json:"message"`
+	PacketType string    `json:"packetType"`
+}
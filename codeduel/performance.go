@@ -0,0 +1,57 @@
+package codeduel
+
+import (
+	"fmt"
+)
+
+// performanceRuns is how many times the hidden tests are run, the median
+// timing of each test is kept to reduce the noise.
+const performanceRuns = 5
+
+// PerformanceMode ranks the users whose submission passes every hidden test
+// by the total wall time of the tests, the fastest first.
+type PerformanceMode struct{}
+
+func (PerformanceMode) Name() string { return "performance" }
+
+func (PerformanceMode) Id() int { return 3 }
+
+func (PerformanceMode) TestCases(challenge Challenge, submit bool) []TestCase {
+	return ClassicMode{}.TestCases(challenge, submit)
+}
+
+func (PerformanceMode) Runs(submit bool) int {
+	if submit {
+		return performanceRuns
+	}
+	return 1
+}
+
+// Score is the total wall time in microseconds, set only when every test
+// passes.
+func (PerformanceMode) Score(_ Settings, testCases []TestCase, result *RunResult) {
+	result.PassedTests = testsPassed(testCases, result.Results)
+	if result.PassedTests != len(testCases) {
+		return
+	}
+	score := int(result.WallTime * 1000)
+	result.Score = &score
+}
+
+func (PerformanceMode) EndsEarly(users map[UserId]*User, state *GameLobbyState) error {
+	if state.SubmitCount >= len(users) {
+		return fmt.Errorf("all users submitted")
+	}
+	return nil
+}
+
+// Leaderboard ranks the correct submissions by runtime, then the others as
+// in the classic mode.
+func (PerformanceMode) Leaderboard(users map[UserId]*User, state *GameLobbyState) []LeaderboardEntry {
+	return buildLeaderboard(users, state, func(a, b LeaderboardEntry) int {
+		if a.Score != nil || b.Score != nil {
+			return compareLowestScore(a, b)
+		}
+		return compareEntries(a, b)
+	})
+}
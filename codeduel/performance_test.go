@@ -0,0 +1,56 @@
+package codeduel
+
+import (
+	"testing"
+)
+
+func TestPerformanceMode(t *testing.T) {
+	_, server := newTestServer(t)
+	owner, id := createLobby(t, server, "u1")
+	player := joinLobby(t, server, id, "u2")
+	startGame(owner, map[string]any{"mode": "performance", "maxPlayers": 4, "gameDuration": 60, "allowedLanguages": []string{"go"}}, player)
+	owner.send(map[string]any{"type": "submit", "code": "ok", "language": "go"})
+	owner.until("submitResult")
+	player.send(map[string]any{"type": "submit", "code": "bad", "language": "go"})
+	player.until("submitResult")
+
+	// the two hidden tests take 1.5ms each on the runner
+	leaderboard := owner.until("gameEnded")["leaderboard"].([]any)
+	first, second := leaderboard[0].(map[string]any), leaderboard[1].(map[string]any)
+	if first["user"].(map[string]any)["id"] != 1.0 || first["score"] != 3000.0 || second["score"] != nil {
+		t.Fatal(leaderboard)
+	}
+}
+
+func TestPerformanceModeZeroTimings(t *testing.T) {
+	_, server := newTestServer(t)
+	owner, id := createLobby(t, server, "u1")
+	player := joinLobby(t, server, id, "u2")
+	startGame(owner, map[string]any{"mode": "performance", "maxPlayers": 4, "gameDuration": 60, "allowedLanguages": []string{"go"}}, player)
+
+	// a missing time is an error, a time of 0ms is the best score
+	owner.send(map[string]any{"type": "check", "code": "untimed", "language": "go", "requestId": "untimed"})
+	if checked := owner.until("checkResult"); checked["requestId"] != "untimed" || checked["error"] == nil {
+		t.Fatal(checked)
+	}
+	owner.send(map[string]any{"type": "submit", "code": "instant", "language": "go"})
+	owner.until("submitResult")
+	player.send(map[string]any{"type": "submit", "code": "ok", "language": "go"})
+	player.until("submitResult")
+
+	leaderboard := owner.until("gameEnded")["leaderboard"].([]any)
+	first, second := leaderboard[0].(map[string]any), leaderboard[1].(map[string]any)
+	if first["user"].(map[string]any)["id"] != 1.0 || first["score"] != 0.0 || second["score"] != 3000.0 {
+		t.Fatal(leaderboard)
+	}
+}
+
+func TestPerformanceModeNeedsTimings(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	server.Config.RunnerTimings = false
+	owner, _ := createLobby(t, httpServer, "u1")
+	owner.send(map[string]any{"type": "updateSettings", "settings": map[string]any{"mode": "performance", "maxPlayers": 4, "gameDuration": 60, "allowedLanguages": []string{"go"}}})
+	if err := owner.until("error"); err["code"] != "invalid_value" {
+		t.Fatal(err)
+	}
+}
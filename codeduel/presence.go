@@ -0,0 +1,119 @@
+package codeduel
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/xedom/codeduel-lobby/codeduel/utils"
+)
+
+var errAllDisconnected = errors.New("all users disconnected")
+
+const (
+	PresenceOnline       = "online"
+	PresenceOffline      = "offline"
+	PresenceDisconnected = "disconnected"
+)
+
+// SetOnline attaches the client to the user, replacing any previous
+// connection of the same user.
+func (lobby *Lobby) SetOnline(user *User, client *Client) {
+	if user.Connection != nil && user.Connection != client {
+		user.Connection.Close(Replaced, "connected from another client")
+	}
+	user.Connection = client
+	user.offlineSince = time.Time{}
+	lobby.setPresence(user, PresenceOnline)
+}
+
+// SetOffline detaches the client from the user and, once the grace period
+// expires without a reconnection, removes the user from the pre-lobby or
+// marks it as disconnected from the match. An owner that does not come back is
+// replaced by the longest-present connected member.
+func (lobby *Lobby) SetOffline(user *User, client *Client, gracePeriod time.Duration) {
+	if user.Connection != client {
+		// the user already reconnected with another client
+		return
+	}
+	user.Connection = nil
+	if lobby.Users[user.Id] != user {
+		// the user was kicked while connected
+		return
+	}
+	user.offlineSince = time.Now()
+	lobby.setPresence(user, PresenceOffline)
+	time.AfterFunc(gracePeriod, func() {
+		_ = lobby.Post(func() { lobby.presenceExpired(user, gracePeriod) })
+	})
+}
+
+// removeUser takes the user out of the pre-lobby and tells the others.
+func (lobby *Lobby) removeUser(state *PreLobbyState, user *User) {
+	delete(lobby.Users, user.Id)
+	state.Ready = utils.Remove(state.Ready, user.Id)
+	lobby.reindex()
+	lobby.assignTeams()
+	lobby.BroadcastPacket(PacketOutUsersUpdate{
+		Users:      lobby.Users,
+		ReadyUsers: lobby.GetReadyUsers(),
+	})
+}
+
+func (lobby *Lobby) presenceExpired(user *User, gracePeriod time.Duration) {
+	if lobby.Users[user.Id] != user || user.Connection != nil || time.Since(user.offlineSince) < gracePeriod {
+		return
+	}
+	if user == lobby.Owner {
+		if next := lobby.nextOwner(); next != nil {
+			lobby.TransferOwnership(next)
+		} else if _, err := lobby.preLobby("close the lobby"); err == nil {
+			// running games are ended by HandleGame, which also keeps the results around
+			log.Printf("Closing lobby %v, nobody is connected\n", lobby.Id)
+			if lobby.registry != nil {
+				lobby.registry.Remove(lobby.Id)
+			}
+			lobby.Close()
+			return
+		}
+	}
+	switch state := lobby.State.(type) {
+	case *PreLobbyState:
+		log.Printf("Removing offline user from lobby: %v\n", user.Username)
+		lobby.removeUser(state, user)
+	case *CountdownLobbyState:
+		lobby.setPresence(user, PresenceDisconnected)
+		if lobby.allDisconnected(nil) {
+			state.context(errAllDisconnected)
+		}
+	case *GameLobbyState:
+		lobby.setPresence(user, PresenceDisconnected)
+		if lobby.allDisconnected(state.Eliminated) {
+			state.match(errAllDisconnected)
+		}
+	case *IntermissionLobbyState:
+		lobby.setPresence(user, PresenceDisconnected)
+		if lobby.allDisconnected(state.eliminated) {
+			state.match(errAllDisconnected)
+		}
+	}
+}
+
+// allDisconnected reports whether every player left in the match is
+// disconnected, the eliminated players only watch it.
+func (lobby *Lobby) allDisconnected(eliminated map[UserId]int) bool {
+	for _, user := range lobby.players(eliminated) {
+		if user.Presence != PresenceDisconnected {
+			return false
+		}
+	}
+	return true
+}
+
+func (lobby *Lobby) setPresence(user *User, presence string) {
+	user.Presence = presence
+	lobby.BroadcastPacket(PacketOutPresence{
+		UserId:   user.Id,
+		Presence: presence,
+	})
+}
@@ -0,0 +1,91 @@
+package codeduel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPresence(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	server.Config.PresenceGracePeriod = 100 * time.Millisecond
+	owner, id := createLobby(t, httpServer, "u1")
+	player := joinLobby(t, httpServer, id, "u2")
+	// wait for the player to be online
+	for owner.until("presence")["userId"] != 2.0 {
+	}
+	_ = player.Close()
+	if presence := owner.until("presence"); presence["presence"] != "offline" {
+		t.Fatal(presence)
+	}
+	// the user is removed once the grace period is over
+	if users := owner.until("usersUpdate"); len(users["users"].(map[string]any)) != 1 {
+		t.Fatal(users)
+	}
+}
+
+func TestKick(t *testing.T) {
+	_, server := newTestServer(t)
+	owner, id := createLobby(t, server, "u1")
+	player := joinLobby(t, server, id, "u2")
+	owner.send(map[string]any{"type": "kick", "userId": 2})
+	if users := owner.until("usersUpdate"); len(users["users"].(map[string]any)) != 1 {
+		t.Fatal(users)
+	}
+	if reason := player.closeReason(); reason != "4433 kicked from the lobby" {
+		t.Fatal(reason)
+	}
+}
+
+func TestAcceptRejectsNonMembers(t *testing.T) {
+	owner := &User{Id: 1}
+	lobby := NewLobby(owner, []string{"go"}, false, 1024)
+	err := lobby.Call(func() error { return lobby.Accept(&User{Id: 2}, &PacketInReady{}) })
+	if ErrorCodeOf(err) != ErrorNotMember {
+		t.Fatal(err)
+	}
+	if err := lobby.Call(func() error { return lobby.Accept(owner, &PacketInReady{}) }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAbandonedCountdown(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	server.Config.PresenceGracePeriod = 100 * time.Millisecond
+	server.Config.Countdown = time.Minute
+	owner, id := createLobby(t, httpServer, "u1")
+	player := joinLobby(t, httpServer, id, "u2")
+	owner.send(map[string]any{"type": "start"})
+	player.until("countdown")
+	_ = owner.Close()
+	_ = player.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for server.Lobbies.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the countdown went on without players")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestAbandonedMatch(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	server.Config.PresenceGracePeriod = 100 * time.Millisecond
+	server.Config.Intermission = time.Minute
+	owner, id := createLobby(t, httpServer, "u1")
+	second := joinLobby(t, httpServer, id, "u2")
+	third := joinLobby(t, httpServer, id, "u3")
+	startGame(owner, map[string]any{"mode": "elimination", "maxPlayers": 4, "gameDuration": 60, "allowedLanguages": []string{"go"}}, second, third)
+	for _, submission := range []struct {
+		player *testClient
+		code   string
+	}{{owner, "ok"}, {second, "ok"}, {third, "bad"}} {
+		submission.player.send(map[string]any{"type": "submit", "code": submission.code, "language": "go"})
+		submission.player.until("submitResult")
+	}
+	third.until("roundEnded")
+
+	// the eliminated player watching the match does not keep it going
+	_ = owner.Close()
+	_ = second.Close()
+	third.until("gameEnded")
+}
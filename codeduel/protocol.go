@@ -0,0 +1,230 @@
+package codeduel
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ProtocolVersion is the version of the lobby protocol spoken on a
+// connection, negotiated with the Sec-WebSocket-Protocol header.
+type ProtocolVersion int
+
+const (
+	// ProtocolV1 is the original protocol, durations are in seconds.
+	ProtocolV1 ProtocolVersion = 1
+	// ProtocolV2 sends and receives durations in milliseconds.
+	ProtocolV2 ProtocolVersion = 2
+	// ProtocolV3 keeps the lobby as a versioned document, updated with
+	// lobbyPatch packets instead of usersUpdate.
+	ProtocolV3 ProtocolVersion = 3
+)
+
+const (
+	protocolPrefix = "codeduel.v"
+	// clients that do not ask for a version predate the negotiation
+	defaultProtocol = ProtocolV1
+)
+
+// PacketEncoder adapts an outbound packet to a protocol version, it returns
+// nil to drop the packet. The packet is shared by every connection of the
+// lobby and by the replay buffer, so an encoder must return a copy instead
+// of modifying what it references.
+type PacketEncoder func(packet any) any
+
+var packetEncoders = map[ProtocolVersion]PacketEncoder{
+	ProtocolV1: encodeV1,
+	ProtocolV2: encodeV2,
+	ProtocolV3: encodeV3,
+}
+
+func (version ProtocolVersion) String() string {
+	return protocolPrefix + strconv.Itoa(int(version))
+}
+
+// Handshake is what was negotiated for a connection. Subprotocols have the
+// form codeduel.v<version>[.<codec>], the codec defaults to JSON.
+type Handshake struct {
+	Version ProtocolVersion
+	Codec   Codec
+	// subprotocol is the accepted value, empty when the client offered none
+	subprotocol string
+}
+
+// negotiateProtocol picks the newest supported version offered by the
+// client, in the first codec offered for it. It returns false when the
+// client offered only unsupported subprotocols.
+func negotiateProtocol(request *http.Request) (Handshake, bool) {
+	offered := websocket.Subprotocols(request)
+	if len(offered) == 0 {
+		return Handshake{Version: defaultProtocol, Codec: JSONCodec{}}, true
+	}
+	var negotiated Handshake
+	for _, protocol := range offered {
+		if handshake, ok := parseProtocol(protocol); ok && handshake.Version > negotiated.Version {
+			negotiated = handshake
+		}
+	}
+	return negotiated, negotiated.Version != 0
+}
+
+func parseProtocol(protocol string) (Handshake, bool) {
+	rest, ok := strings.CutPrefix(protocol, protocolPrefix)
+	if !ok {
+		return Handshake{}, false
+	}
+	number, codecName, found := strings.Cut(rest, ".")
+	if !found {
+		codecName = JSONCodec{}.Name()
+	}
+	version, err := strconv.Atoi(number)
+	if err != nil {
+		return Handshake{}, false
+	}
+	codec, ok := codecs[codecName]
+	if !ok {
+		return Handshake{}, false
+	}
+	if _, ok := packetEncoders[ProtocolVersion(version)]; !ok {
+		return Handshake{}, false
+	}
+	return Handshake{Version: ProtocolVersion(version), Codec: codec, subprotocol: protocol}, true
+}
+
+// supportedProtocols describes the accepted subprotocols, listing versions
+// and codecs separately to keep the close reason short.
+func supportedProtocols() string {
+	versions := make([]string, 0, len(packetEncoders))
+	for version := range packetEncoders {
+		versions = append(versions, version.String())
+	}
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	slices.Sort(versions)
+	slices.Sort(names)
+	return fmt.Sprintf("versions %s, codecs %s", strings.Join(versions, ", "), strings.Join(names, ", "))
+}
+
+// header is the response header accepting the subprotocol. Clients that
+// did not offer any must not receive one.
+func (handshake Handshake) header() http.Header {
+	if handshake.subprotocol == "" {
+		return nil
+	}
+	return http.Header{"Sec-WebSocket-Protocol": {handshake.subprotocol}}
+}
+
+// negotiate rejects the connection with UnsupportedProtocol when none of the
+// subprotocols offered by the client is supported.
+func (s *APIServer) negotiate(response http.ResponseWriter, request *http.Request) (Handshake, bool) {
+	handshake, ok := negotiateProtocol(request)
+	if !ok {
+		message := fmt.Sprintf("unsupported protocol, supported %s", supportedProtocols())
+		_ = RejectConnection(response, request, UnsupportedProtocol, message)
+	}
+	return handshake, ok
+}
+
+func encodeV1(packet any) any {
+	if _, ok := packet.(PacketOutLobbyPatch); ok {
+		return nil
+	}
+	return encodeLegacyRuns(ProtocolV1.encodeSettings(packet))
+}
+
+func encodeV2(packet any) any {
+	if _, ok := packet.(PacketOutLobbyPatch); ok {
+		return nil
+	}
+	return encodeLegacyRuns(ProtocolV2.encodeSettings(packet))
+}
+
+// legacyGameLobbyState is the round as the versions before ProtocolV3 see
+// it, with the runs in the usersState. UsersState comes first to hide the
+// one of GameLobbyState from msgpack, which keeps the first field of a name.
+type legacyGameLobbyState struct {
+	UsersState map[UserId]legacyUserGameLobbyState `json:"usersState"`
+	GameLobbyState
+}
+
+type legacyUserGameLobbyState struct {
+	UserGameLobbyState
+	UserRuns
+}
+
+// encodeLegacyRuns moves the runs of the receiving user back into its
+// usersState, where the versions before ProtocolV3 read them. The runs of
+// the other users stay null.
+func encodeLegacyRuns(packet any) any {
+	lobby, ok := packet.(PacketOutLobby)
+	if !ok {
+		return packet
+	}
+	state, ok := lobby.State.(*GameLobbyState)
+	if !ok {
+		return packet
+	}
+	legacy := &legacyGameLobbyState{
+		UsersState:     make(map[UserId]legacyUserGameLobbyState, len(state.UsersState)),
+		GameLobbyState: *state,
+	}
+	for id, userState := range state.UsersState {
+		legacyState := legacyUserGameLobbyState{UserGameLobbyState: userState}
+		if lobby.Runs != nil && lobby.Runs.user == id {
+			legacyState.UserRuns = *lobby.Runs
+		}
+		legacy.UsersState[id] = legacyState
+	}
+	lobby.State = legacy
+	lobby.Runs = nil
+	return lobby
+}
+
+// encodeV3 replaces usersUpdate with the patches of the lobby document,
+// which are built with the settings of this version.
+func encodeV3(packet any) any {
+	if _, ok := packet.(PacketOutUsersUpdate); ok {
+		return nil
+	}
+	return ProtocolV3.encodeSettings(packet)
+}
+
+// encodeSettings converts the settings carried by the packet.
+func (version ProtocolVersion) encodeSettings(packet any) any {
+	switch packet := packet.(type) {
+	case PacketOutLobby:
+		packet.Settings = version.EncodeSettings(packet.Settings)
+		return packet
+	case PacketOutSettingsUpdated:
+		packet.Settings = version.EncodeSettings(packet.Settings)
+		return packet
+	}
+	return packet
+}
+
+// durationUnit is the unit of the durations sent and received.
+func (version ProtocolVersion) durationUnit() time.Duration {
+	if version >= ProtocolV2 {
+		return time.Millisecond
+	}
+	return time.Second
+}
+
+// DecodeSettings converts inbound settings to the internal representation.
+func (version ProtocolVersion) DecodeSettings(settings Settings) Settings {
+	settings.GameDuration *= version.durationUnit()
+	return settings
+}
+
+// EncodeSettings converts the settings to the representation of the version.
+func (version ProtocolVersion) EncodeSettings(settings Settings) Settings {
+	settings.GameDuration /= version.durationUnit()
+	return settings
+}
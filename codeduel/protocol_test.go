@@ -0,0 +1,33 @@
+package codeduel
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProtocolNegotiation(t *testing.T) {
+	_, server := newTestServer(t)
+	owner := dialLobby(t, server, "/create", "u1", "codeduel.v2", "codeduel.v1")
+	if owner.Subprotocol() != "codeduel.v2" {
+		t.Fatal(owner.Subprotocol())
+	}
+	id := owner.until("lobby")["id"].(string)
+	owner.send(map[string]any{"type": "updateSettings", "settings": classicSettings(60000)})
+
+	// clients offering no subprotocol speak the first version, in seconds
+	player := dialLobby(t, server, "/join/"+id, "u2")
+	if player.Subprotocol() != "" {
+		t.Fatal(player.Subprotocol())
+	}
+	if settings := player.until("lobby")["settings"].(map[string]any); settings["gameDuration"] != 60.0 {
+		t.Fatal(settings)
+	}
+	reconnected := dialLobby(t, server, "/connect/"+id, "u1", "codeduel.v2")
+	if settings := reconnected.until("lobby")["settings"].(map[string]any); settings["gameDuration"] != 60000.0 {
+		t.Fatal(settings)
+	}
+	unsupported := dialLobby(t, server, "/connect/"+id, "u2", "codeduel.v9")
+	if reason := unsupported.closeReason(); !strings.HasPrefix(reason, "4406 ") {
+		t.Fatal(reason)
+	}
+}
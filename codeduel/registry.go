@@ -0,0 +1,163 @@
+package codeduel
+
+import (
+	"sync"
+)
+
+// LobbyRegistry keeps track of every open lobby and indexes them by owner,
+// by the users currently inside and by state. It is safe for concurrent use.
+//
+// The registry never calls into a lobby while holding its lock, so lobbies
+// can update their index entry from inside their own events.
+type LobbyRegistry struct {
+	lock    sync.RWMutex
+	lobbies map[string]*Lobby
+	entries map[string]lobbyIndexEntry
+	byOwner map[UserId]map[string]*Lobby
+	byUser  map[UserId]map[string]*Lobby
+	byState map[string]map[string]*Lobby
+}
+
+type lobbyIndexEntry struct {
+	owner UserId
+	users []UserId
+	state string
+}
+
+func NewLobbyRegistry() *LobbyRegistry {
+	return &LobbyRegistry{
+		lobbies: map[string]*Lobby{},
+		entries: map[string]lobbyIndexEntry{},
+		byOwner: map[UserId]map[string]*Lobby{},
+		byUser:  map[UserId]map[string]*Lobby{},
+		byState: map[string]map[string]*Lobby{},
+	}
+}
+
+// Add registers the lobby, from inside one of its events.
+func (registry *LobbyRegistry) Add(lobby *Lobby) {
+	lobby.registry = registry
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	registry.lobbies[lobby.Id] = lobby
+	registry.index(lobby, entryOf(lobby))
+}
+
+// Update refreshes the index entry of the lobby, it is a no-op if the lobby
+// was already removed.
+func (registry *LobbyRegistry) Update(lobby *Lobby) {
+	entry := entryOf(lobby)
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	if _, ok := registry.lobbies[lobby.Id]; !ok {
+		return
+	}
+	registry.unindex(lobby.Id)
+	registry.index(lobby, entry)
+}
+
+func (registry *LobbyRegistry) Remove(id string) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	if _, ok := registry.lobbies[id]; !ok {
+		return
+	}
+	registry.unindex(id)
+	delete(registry.lobbies, id)
+}
+
+func (registry *LobbyRegistry) Get(id string) (*Lobby, bool) {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+	lobby, ok := registry.lobbies[id]
+	return lobby, ok
+}
+
+func (registry *LobbyRegistry) Len() int {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+	return len(registry.lobbies)
+}
+
+func (registry *LobbyRegistry) List() []*Lobby {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+	return values(registry.lobbies)
+}
+
+// Range calls fn for every lobby until it returns false. It iterates over a
+// snapshot, so fn is free to call into the lobby or the registry.
+func (registry *LobbyRegistry) Range(fn func(lobby *Lobby) bool) {
+	for _, lobby := range registry.List() {
+		if !fn(lobby) {
+			return
+		}
+	}
+}
+
+func (registry *LobbyRegistry) ByOwner(owner UserId) []*Lobby {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+	return values(registry.byOwner[owner])
+}
+
+func (registry *LobbyRegistry) ByUser(user UserId) []*Lobby {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+	return values(registry.byUser[user])
+}
+
+func (registry *LobbyRegistry) ByState(state string) []*Lobby {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+	return values(registry.byState[state])
+}
+
+func entryOf(lobby *Lobby) lobbyIndexEntry {
+	return lobbyIndexEntry{
+		owner: lobby.Owner.Id,
+		users: keys(lobby.Users),
+		state: lobby.State.StateType(),
+	}
+}
+
+func (registry *LobbyRegistry) index(lobby *Lobby, entry lobbyIndexEntry) {
+	registry.entries[lobby.Id] = entry
+	addToIndex(registry.byOwner, entry.owner, lobby)
+	for _, user := range entry.users {
+		addToIndex(registry.byUser, user, lobby)
+	}
+	addToIndex(registry.byState, entry.state, lobby)
+}
+
+func (registry *LobbyRegistry) unindex(id string) {
+	entry := registry.entries[id]
+	removeFromIndex(registry.byOwner, entry.owner, id)
+	for _, user := range entry.users {
+		removeFromIndex(registry.byUser, user, id)
+	}
+	removeFromIndex(registry.byState, entry.state, id)
+	delete(registry.entries, id)
+}
+
+func addToIndex[K comparable](index map[K]map[string]*Lobby, key K, lobby *Lobby) {
+	if index[key] == nil {
+		index[key] = map[string]*Lobby{}
+	}
+	index[key][lobby.Id] = lobby
+}
+
+func removeFromIndex[K comparable](index map[K]map[string]*Lobby, key K, id string) {
+	delete(index[key], id)
+	if len(index[key]) == 0 {
+		delete(index, key)
+	}
+}
+
+func values[K comparable, V any](dict map[K]V) []V {
+	values := make([]V, 0, len(dict))
+	for _, v := range dict {
+		values = append(values, v)
+	}
+	return values
+}
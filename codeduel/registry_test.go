@@ -0,0 +1,41 @@
+package codeduel
+
+import (
+	"testing"
+)
+
+func TestLobbyRegistry(t *testing.T) {
+	registry := NewLobbyRegistry()
+	lobby := NewLobby(&User{Id: 1}, []string{"go"}, false, 1024)
+	if err := lobby.Do(func() { registry.Add(lobby) }); err != nil {
+		t.Fatal(err)
+	}
+	if found, ok := registry.Get(lobby.Id); !ok || found != lobby {
+		t.Fatal("lobby not found")
+	}
+	if len(registry.ByOwner(1)) != 1 || len(registry.ByUser(1)) != 1 || len(registry.ByState(StatePreLobby)) != 1 {
+		t.Fatal("lobby not indexed")
+	}
+
+	if err := lobby.Do(func() {
+		lobby.Users[2] = &User{Id: 2}
+		registry.Update(lobby)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(registry.ByUser(2)) != 1 {
+		t.Fatal("user 2 not indexed")
+	}
+
+	registry.Remove(lobby.Id)
+	if registry.Len() != 0 || len(registry.ByOwner(1)) != 0 || len(registry.ByUser(2)) != 0 || len(registry.ByState(StatePreLobby)) != 0 {
+		t.Fatal("lobby still indexed")
+	}
+	// updates after the removal must not add the lobby back
+	if err := lobby.Do(func() { registry.Update(lobby) }); err != nil {
+		t.Fatal(err)
+	}
+	if registry.Len() != 0 || len(registry.ByOwner(1)) != 0 {
+		t.Fatal("lobby indexed after removal")
+	}
+}
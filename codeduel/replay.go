@@ -0,0 +1,115 @@
+package codeduel
+
+import (
+	"net/http"
+	"strconv"
+)
+
+const (
+	replayBufferSize = 256
+	// maxReplay is the most packets replayed to a reconnecting user, leaving
+	// room in the send queue for the packets that follow. A larger gap is
+	// filled with a snapshot instead.
+	maxReplay = sendQueueSize / 2
+)
+
+// replayBuffer assigns a lobby-wide, monotonically increasing sequence
+// number to every outbound packet and keeps the latest ones, so that a
+// reconnecting user can receive exactly the packets it missed.
+type replayBuffer struct {
+	seq     uint64
+	entries []replayEntry
+}
+
+type replayEntry struct {
+	seq     uint64
+	to      *UserId // nil when the packet was broadcast
+	message *outboundMessage
+}
+
+// push stamps the packet with the next sequence number and stores it.
+func (buffer *replayBuffer) push(to *UserId, packet any) *outboundMessage {
+	buffer.seq++
+	message := &outboundMessage{packet: packet, seq: buffer.seq}
+	buffer.entries = append(buffer.entries, replayEntry{
+		seq:     buffer.seq,
+		to:      to,
+		message: message,
+	})
+	if len(buffer.entries) > replayBufferSize {
+		buffer.entries = buffer.entries[len(buffer.entries)-replayBufferSize:]
+	}
+	return message
+}
+
+// since returns the packets addressed to the user after lastSeq. It returns
+// false when some of them were already dropped from the buffer.
+func (buffer *replayBuffer) since(lastSeq uint64, user UserId) ([]*outboundMessage, bool) {
+	if lastSeq > buffer.seq {
+		return nil, false
+	}
+	if lastSeq < buffer.seq && (len(buffer.entries) == 0 || buffer.entries[0].seq > lastSeq+1) {
+		return nil, false
+	}
+	var messages []*outboundMessage
+	for _, entry := range buffer.entries {
+		if entry.seq > lastSeq && (entry.to == nil || *entry.to == user) {
+			messages = append(messages, entry.message)
+		}
+	}
+	return messages, true
+}
+
+// replayable reports whether every message was encoded in the wire format of
+// the client when it was sent. The packets may reference the users or the
+// state of the lobby, which keep changing, so they cannot be encoded again
+// for a replay.
+func replayable(messages []*outboundMessage, client *Client) bool {
+	for _, message := range messages {
+		if _, ok := message.cached(client.Protocol, client.Codec); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// SendPacket sequences the packet and sends it to the user if connected.
+func (lobby *Lobby) SendPacket(user *User, packet any) error {
+	sequenced := lobby.replay.push(&user.Id, packet)
+	if user.Connection == nil {
+		return nil
+	}
+	return user.Connection.sendMessage(sequenced)
+}
+
+// resume sends the user either the packets missed since lastSeq or, when
+// there is no lastSeq, the gap is too large or the packets were not sent in
+// the wire format of the client, a full lobby snapshot.
+func (lobby *Lobby) resume(client *Client, user *User, lastSeq *uint64) error {
+	if lastSeq != nil {
+		missed, ok := lobby.replay.since(*lastSeq, user.Id)
+		if ok && len(missed) <= maxReplay && replayable(missed, client) {
+			for _, message := range missed {
+				if err := client.sendMessage(message); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	// the snapshot describes the lobby as of the latest packet
+	return client.sendMessage(&outboundMessage{packet: lobby.snapshot(user, ""), seq: lobby.replay.seq})
+}
+
+// parseLastSeq reads the last sequence number seen by a reconnecting client.
+func parseLastSeq(request *http.Request) *uint64 {
+	value := request.URL.Query().Get("lastSeq")
+	if value == "" {
+		return nil
+	}
+	lastSeq, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return nil
+	}
+	return &lastSeq
+}
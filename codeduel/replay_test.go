@@ -0,0 +1,98 @@
+package codeduel
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResume(t *testing.T) {
+	_, server := newTestServer(t)
+	owner, id := createLobby(t, server, "u1")
+	player := joinLobby(t, server, id, "u2")
+	lastSeq := int(player.until("usersUpdate")["seq"].(float64))
+	_ = player.Close()
+	time.Sleep(50 * time.Millisecond)
+	owner.send(map[string]any{"type": "ready", "ready": true})
+	time.Sleep(50 * time.Millisecond)
+
+	// the packets missed while offline are replayed instead of a snapshot
+	player = dialLobby(t, server, fmt.Sprintf("/connect/%s?lastSeq=%d", id, lastSeq), "u2")
+	replayed := player.until("presence")
+	if int(replayed["seq"].(float64)) <= lastSeq || replayed["presence"] != "offline" {
+		t.Fatal(replayed)
+	}
+
+	// without a lastSeq the client gets the whole lobby
+	player = dialLobby(t, server, "/connect/"+id, "u2")
+	if lobby := player.until("lobby"); lobby["id"] != id {
+		t.Fatal(lobby)
+	}
+}
+
+func TestResumeLongGap(t *testing.T) {
+	_, server := newTestServer(t)
+	owner, id := createLobby(t, server, "u1")
+	player := joinLobby(t, server, id, "u2")
+	lastSeq := int(player.until("usersUpdate")["seq"].(float64))
+	_ = player.Close()
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < maxReplay; i++ {
+		owner.send(map[string]any{"type": "ready", "ready": i%2 == 0})
+	}
+	owner.send(map[string]any{"type": "resync", "requestId": "resync"})
+	owner.until("lobby")
+
+	// too many packets were missed to replay them, the client gets the lobby
+	player = dialLobby(t, server, fmt.Sprintf("/connect/%s?lastSeq=%d", id, lastSeq), "u2")
+	if lobby := player.until("lobby"); lobby["id"] != id || lobby["requestId"] != nil {
+		t.Fatal(lobby)
+	}
+	player.send(map[string]any{"type": "resync", "requestId": "resync"})
+	if lobby := player.until("lobby"); lobby["requestId"] != "resync" {
+		t.Fatal(lobby)
+	}
+}
+
+func TestReplayKeepsPastState(t *testing.T) {
+	var buffer replayBuffer
+	users := map[UserId]*User{1: {Id: 1, Username: "before"}}
+	message := buffer.push(nil, PacketOutUsersUpdate{Users: users})
+	// sending the packet encodes it in the format of the receiver
+	if _, err := message.encode(ProtocolV1, JSONCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	users[1].Username = "after"
+	missed, ok := buffer.since(0, 1)
+	if !ok || len(missed) != 1 {
+		t.Fatal(missed, ok)
+	}
+	if !replayable(missed, &Client{Protocol: ProtocolV1, Codec: JSONCodec{}}) {
+		t.Fatal("not replayable in the format it was sent in")
+	}
+	if bytes, _ := missed[0].cached(ProtocolV1, JSONCodec{}); !strings.Contains(string(bytes), "before") {
+		t.Fatal(string(bytes))
+	}
+	// other formats would show the users as they are now
+	if replayable(missed, &Client{Protocol: ProtocolV2, Codec: JSONCodec{}}) {
+		t.Fatal("replayable in a format it was not sent in")
+	}
+}
+
+func TestResumeOtherFormat(t *testing.T) {
+	_, server := newTestServer(t)
+	owner, id := createLobby(t, server, "u1")
+	player := joinLobby(t, server, id, "u2")
+	lastSeq := int(player.until("usersUpdate")["seq"].(float64))
+	_ = player.Close()
+	time.Sleep(50 * time.Millisecond)
+	owner.send(map[string]any{"type": "ready", "ready": true})
+	time.Sleep(50 * time.Millisecond)
+
+	// the missed packets were only encoded for the owner, in another protocol
+	player = dialLobby(t, server, fmt.Sprintf("/connect/%s?lastSeq=%d", id, lastSeq), "u2", "codeduel.v3")
+	if lobby := player.until("lobby"); lobby["id"] != id {
+		t.Fatal(lobby)
+	}
+}
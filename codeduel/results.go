@@ -0,0 +1,104 @@
+package codeduel
+
+import (
+	"sort"
+)
+
+// LeaderboardEntry is the final standing of a user. SubmittedAfter is the
+// number of milliseconds between the start of the game and the submission,
+// it is nil for users that never submitted.
+type LeaderboardEntry struct {
+	Rank           int    `json:"rank"`
+	User           *User  `json:"user"`
+	Submitted      bool   `json:"submitted"`
+	PassedTests    int    `json:"passedTests"`
+	Score          *int   `json:"score,omitempty"`
+	Team           int    `json:"team,omitempty"`
+	Language       string `json:"language,omitempty"`
+	SubmittedAfter *int64 `json:"submittedAfter"`
+}
+
+// BuildLeaderboard ranks the users by passed tests, then by how fast they
+// submitted. Users that did not submit are listed last and share the same
+// rank, as do users with the same number of passed tests and submission time.
+func BuildLeaderboard(users map[UserId]*User, state *GameLobbyState) []LeaderboardEntry {
+	return buildLeaderboard(users, state, compareEntries)
+}
+
+// buildLeaderboard ranks the submissions of the users with compare, users
+// comparing equal share the same rank.
+func buildLeaderboard(users map[UserId]*User, state *GameLobbyState, compare func(a, b LeaderboardEntry) int) []LeaderboardEntry {
+	leaderboard := make([]LeaderboardEntry, 0, len(users))
+	for _, user := range users {
+		entry := LeaderboardEntry{User: user}
+		if result := state.UsersState[user.Id].runs.SubmitResult; result != nil {
+			submittedAfter := result.Date.Sub(state.StartTime).Milliseconds()
+			entry.Submitted = true
+			entry.PassedTests = result.PassedTests
+			entry.Score = result.Score
+			entry.Language = result.Language
+			entry.SubmittedAfter = &submittedAfter
+		}
+		leaderboard = append(leaderboard, entry)
+	}
+	sort.SliceStable(leaderboard, func(i, j int) bool {
+		if compared := compare(leaderboard[i], leaderboard[j]); compared != 0 {
+			return compared < 0
+		}
+		return leaderboard[i].User.Id < leaderboard[j].User.Id
+	})
+	for i := range leaderboard {
+		if i > 0 && compare(leaderboard[i-1], leaderboard[i]) == 0 {
+			leaderboard[i].Rank = leaderboard[i-1].Rank
+		} else {
+			leaderboard[i].Rank = i + 1
+		}
+	}
+	return leaderboard
+}
+
+// compareEntries returns a negative number when a ranks before b.
+func compareEntries(a, b LeaderboardEntry) int {
+	if a.Submitted != b.Submitted {
+		if a.Submitted {
+			return -1
+		}
+		return 1
+	}
+	if !a.Submitted {
+		return 0
+	}
+	if a.PassedTests != b.PassedTests {
+		return b.PassedTests - a.PassedTests
+	}
+	return compareSubmittedAfter(a, b)
+}
+
+// compareLowestScore ranks the lowest scores first, then the earliest
+// submissions. Users without a score share the last rank.
+func compareLowestScore(a, b LeaderboardEntry) int {
+	if (a.Score == nil) != (b.Score == nil) {
+		if a.Score != nil {
+			return -1
+		}
+		return 1
+	}
+	if a.Score == nil {
+		return 0
+	}
+	if *a.Score != *b.Score {
+		return *a.Score - *b.Score
+	}
+	return compareSubmittedAfter(a, b)
+}
+
+// compareSubmittedAfter ranks the earliest submission first.
+func compareSubmittedAfter(a, b LeaderboardEntry) int {
+	switch {
+	case *a.SubmittedAfter < *b.SubmittedAfter:
+		return -1
+	case *a.SubmittedAfter > *b.SubmittedAfter:
+		return 1
+	}
+	return 0
+}
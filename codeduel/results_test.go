@@ -0,0 +1,34 @@
+package codeduel
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBuildLeaderboard(t *testing.T) {
+	start := time.Now()
+	users := map[UserId]*User{}
+	state := &GameLobbyState{StartTime: start, UsersState: map[UserId]UserGameLobbyState{}}
+	submit := func(id UserId, passedTests int, after time.Duration) {
+		userState := state.UsersState[id]
+		userState.submit(&RunResult{PassedTests: passedTests, Date: start.Add(after)})
+		state.UsersState[id] = userState
+	}
+	for id := UserId(1); id <= 6; id++ {
+		users[id] = &User{Id: id}
+	}
+	submit(1, 1, 2*time.Second)
+	submit(2, 2, 3*time.Second)
+	submit(3, 2, 3*time.Second)
+	submit(4, 2, time.Second)
+
+	var ranks []string
+	for _, entry := range BuildLeaderboard(users, state) {
+		ranks = append(ranks, fmt.Sprintf("%d:%d", entry.User.Id, entry.Rank))
+	}
+	// more tests first, then the earliest submission, without a submission last
+	if got := fmt.Sprint(ranks); got != "[4:1 2:2 3:2 1:4 5:5 6:5]" {
+		t.Fatal(got)
+	}
+}
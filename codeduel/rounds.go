@@ -0,0 +1,155 @@
+package codeduel
+
+import (
+	"slices"
+	"sort"
+	"time"
+)
+
+const maxRounds = 10
+
+// RoundSettings make the game a match of Count rounds, each with a new
+// challenge. With BestOf the match ends as soon as a user won more than
+// half of the rounds.
+type RoundSettings struct {
+	Count  int  `json:"count"`
+	BestOf bool `json:"bestOf"`
+}
+
+// ScoreboardEntry is the standing of a user over the rounds of a match.
+// Each round gives a point for every user ranked below, and a win to the
+// users ranked first.
+type ScoreboardEntry struct {
+	Rank   int   `json:"rank"`
+	User   *User `json:"user"`
+	Team   int   `json:"team,omitempty"`
+	Points int   `json:"points"`
+	Wins   int   `json:"wins"`
+	// EliminatedIn is the round after which the user was eliminated, in the
+	// elimination mode.
+	EliminatedIn int `json:"eliminatedIn,omitempty"`
+}
+
+// roundResult is the outcome of a finished round.
+type roundResult struct {
+	game        *GameLobbyState
+	leaderboard []LeaderboardEntry
+	teams       []TeamEntry
+}
+
+// roundResults ranks the users of the round.
+func (lobby *Lobby) roundResults(state *GameLobbyState) roundResult {
+	result := roundResult{
+		game:        state,
+		leaderboard: lobby.mode().Leaderboard(lobby.players(state.Eliminated), state),
+	}
+	if teamMode, ok := lobby.teamMode(); ok {
+		for i, entry := range result.leaderboard {
+			result.leaderboard[i].Team = lobby.teams[entry.User.Id]
+		}
+		result.teams = teamMode.TeamLeaderboard(lobby.Settings.Teams, lobby.teams, result.leaderboard)
+	}
+	return result
+}
+
+// addRound returns the scoreboard with the points and wins of the round,
+// ranked by points or, with bestOf, by wins. The users eliminated last rank
+// below the others.
+func addRound(scoreboard []ScoreboardEntry, leaderboard []LeaderboardEntry, bestOf bool, eliminated map[UserId]int) []ScoreboardEntry {
+	// the previous scoreboard is still part of earlier states
+	scoreboard = slices.Clone(scoreboard)
+	index := map[UserId]int{}
+	for i, entry := range scoreboard {
+		index[entry.User.Id] = i
+	}
+	for _, round := range leaderboard {
+		i, ok := index[round.User.Id]
+		if !ok {
+			i = len(scoreboard)
+			index[round.User.Id] = i
+			scoreboard = append(scoreboard, ScoreboardEntry{User: round.User, Team: round.Team})
+		}
+		entry := &scoreboard[i]
+		if !round.Submitted {
+			continue
+		}
+		for _, other := range leaderboard {
+			if other.Rank > round.Rank {
+				entry.Points++
+			}
+		}
+		if round.Rank == 1 {
+			entry.Wins++
+		}
+	}
+	for i := range scoreboard {
+		scoreboard[i].EliminatedIn = eliminated[scoreboard[i].User.Id]
+	}
+	compare := func(a, b ScoreboardEntry) int {
+		if a.EliminatedIn != b.EliminatedIn {
+			if a.EliminatedIn == 0 || b.EliminatedIn == 0 {
+				return a.EliminatedIn - b.EliminatedIn
+			}
+			return b.EliminatedIn - a.EliminatedIn
+		}
+		if bestOf && a.Wins != b.Wins {
+			return b.Wins - a.Wins
+		}
+		if a.Points != b.Points {
+			return b.Points - a.Points
+		}
+		return b.Wins - a.Wins
+	}
+	sort.SliceStable(scoreboard, func(i, j int) bool {
+		if compared := compare(scoreboard[i], scoreboard[j]); compared != 0 {
+			return compared < 0
+		}
+		return scoreboard[i].User.Id < scoreboard[j].User.Id
+	})
+	for i := range scoreboard {
+		if i > 0 && compare(scoreboard[i-1], scoreboard[i]) == 0 {
+			scoreboard[i].Rank = scoreboard[i-1].Rank
+		} else {
+			scoreboard[i].Rank = i + 1
+		}
+	}
+	return scoreboard
+}
+
+// rounds returns how many rounds the match plays, as known before round.
+func (lobby *Lobby) rounds(round int, eliminated map[UserId]int) int {
+	if _, ok := lobby.eliminationMode(); ok {
+		return lobby.Settings.Elimination.rounds(round, len(lobby.players(eliminated)))
+	}
+	return lobby.Settings.Rounds.Count
+}
+
+// matchOver reports whether no round is left to play after the round of
+// state, which left the players not in eliminated.
+func (lobby *Lobby) matchOver(scoreboard []ScoreboardEntry, state *GameLobbyState, eliminated map[UserId]int) bool {
+	if _, ok := lobby.eliminationMode(); ok {
+		return len(lobby.players(eliminated)) <= 1
+	}
+	settings := lobby.Settings.Rounds
+	if state.Round >= settings.Count {
+		return true
+	}
+	if !settings.BestOf {
+		return false
+	}
+	for _, entry := range scoreboard {
+		if entry.Wins > settings.Count/2 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOpen rejects the runs sent after the deadline, while the round is
+// being ended.
+func (state *GameLobbyState) checkOpen() error {
+	if !time.Now().Before(state.Deadline) {
+		return NewLobbyError(ErrorInvalidState, "round %d is over", state.Round)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package codeduel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRounds(t *testing.T) {
+	_, server := newTestServer(t)
+	owner, id := createLobby(t, server, "u1")
+	player := joinLobby(t, server, id, "u2")
+	owner.send(map[string]any{"type": "updateSettings", "settings": map[string]any{"maxPlayers": 4, "gameDuration": 60, "allowedLanguages": []string{"go"}, "rounds": map[string]any{"count": 3, "bestOf": true}}})
+	owner.send(map[string]any{"type": "start"})
+	for round := 1; round <= 2; round++ {
+		started := owner.until("gameStarted")
+		if started["round"] != float64(round) || started["rounds"] != 3.0 {
+			t.Fatal(started)
+		}
+		player.until("gameStarted")
+		owner.send(map[string]any{"type": "submit", "code": "ok", "language": "go"})
+		owner.until("submitResult")
+		player.send(map[string]any{"type": "submit", "code": "bad", "language": "go"})
+		player.until("submitResult")
+		if round > 1 {
+			continue
+		}
+		ended := owner.until("roundEnded")
+		if first := ended["scoreboard"].([]any)[0].(map[string]any); first["wins"] != 1.0 || first["points"] != 1.0 {
+			t.Fatal(ended)
+		}
+		// the next challenge is fetched during the intermission
+		player = dialLobby(t, server, "/connect/"+id, "u2")
+		if state := player.until("lobby")["state"].(map[string]any); state["type"] != StateIntermission {
+			t.Fatal(state)
+		}
+	}
+
+	// two wins out of three end the match early
+	ended := owner.until("gameEnded")
+	scoreboard := ended["scoreboard"].([]any)
+	if len(scoreboard) != 2 || scoreboard[0].(map[string]any)["wins"] != 2.0 {
+		t.Fatal(ended)
+	}
+}
+
+func TestRoundDeadline(t *testing.T) {
+	state := &GameLobbyState{Round: 2, Deadline: time.Now().Add(time.Minute)}
+	if err := state.checkOpen(); err != nil {
+		t.Fatal(err)
+	}
+	state.Deadline = time.Now()
+	if err := state.checkOpen(); ErrorCodeOf(err) != ErrorInvalidState {
+		t.Fatal(err)
+	}
+}
+
+func TestLateCheck(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	runnerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		_ = json.NewEncoder(w).Encode(map[string]any{"result": []map[string]any{{"output": "1"}}})
+	}))
+	defer runnerServer.Close()
+	runner := NewRunner(runnerServer.URL)
+	owner := &User{Id: 1}
+	lobby := NewLobby(owner, []string{"go"}, false, 1024)
+	round := func(number int) *GameLobbyState {
+		challenge := Challenge{TestCases: []TestCase{{Input: "1", Output: "1"}}}
+		return &GameLobbyState{Type: StateGame, Round: number, Challenge: challenge, Deadline: time.Now().Add(time.Minute), UsersState: map[UserId]UserGameLobbyState{}}
+	}
+	next := round(2)
+	_ = lobby.Do(func() { lobby.State = round(1) })
+	done := make(chan error)
+	go func() {
+		_, err := lobby.RunTest(owner, &runner, "go", "ok")
+		done <- err
+	}()
+
+	// the next round starts while the runner is busy
+	<-started
+	_ = lobby.Do(func() { lobby.State = next })
+	close(release)
+	if err := <-done; ErrorCodeOf(err) != ErrorInvalidState {
+		t.Fatal(err)
+	}
+	_ = lobby.Read(func() {
+		if runs := next.UsersState[owner.Id].runs; runs.LastRunResult != nil {
+			t.Fatal(runs)
+		}
+	})
+}
+
+func TestFirstRoundFailure(t *testing.T) {
+	server, _ := newTestServer(t)
+	lobby := NewLobby(&User{Id: 1}, []string{"go"}, false, 1024)
+	_ = lobby.Do(func() { server.Lobbies.Add(lobby) })
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	// the lobby never left the pre-lobby, the first round cannot start
+	server.games.Add(1)
+	server.HandleGame(lobby, ctx, &CountdownLobbyState{Type: StateCountdown, StartTime: time.Now(), context: cancel})
+	if _, ok := server.Lobbies.Get(lobby.Id); ok {
+		t.Fatal("lobby still registered")
+	}
+	if err := lobby.Do(func() {}); !errors.Is(err, ErrLobbyClosed) {
+		t.Fatal(err)
+	}
+}
@@ -16,10 +16,15 @@ type ApiResult struct {
 	Result []ExecutionResult `json:"result"`
 }
 
+// ExecutionResult is the outcome of a test. WallTime and CpuTime are in
+// milliseconds, as reported by the runner, and nil when it did not time the
+// test.
 type ExecutionResult struct {
-	Output string `json:"output"`
-	Error  string `json:"errors"`
-	Status int64  `json:"status"`
+	Output   string   `json:"output"`
+	Error    string   `json:"errors"`
+	Status   int64    `json:"status"`
+	WallTime *float64 `json:"wallTime"`
+	CpuTime  *float64 `json:"cpuTime"`
 }
 
 func NewRunner(url string) Runner {
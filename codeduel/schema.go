@@ -0,0 +1,358 @@
+package codeduel
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const schemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// Schema is the subset of JSON Schema generated from the packet types.
+type Schema struct {
+	Dialect              string             `json:"$schema,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Const                any                `json:"const,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	AnyOf                []*Schema          `json:"anyOf,omitempty"`
+	Defs                 map[string]*Schema `json:"$defs,omitempty"`
+
+	// order keeps the properties in the order of the struct fields
+	order []string
+}
+
+// SchemaError describes where a packet does not match its schema.
+type SchemaError struct {
+	Path    string
+	Message string
+}
+
+func (err *SchemaError) Error() string {
+	if err.Path == "" {
+		return err.Message
+	}
+	return fmt.Sprintf("%s: %s", err.Path, err.Message)
+}
+
+// PacketRegistry maps the wire name of each packet to its Go type. The
+// registry is the single source for decoding, encoding and the generated
+// JSON Schema and TypeScript definitions.
+type PacketRegistry struct {
+	// Title names the union of the packets in the generated files.
+	Title string
+	// Fields are the properties added to every packet on the wire, besides type.
+	Fields any
+	// Strict marks the fields without omitempty as required.
+	Strict bool
+
+	names     []string
+	types     map[string]reflect.Type
+	byType    map[reflect.Type]string
+	envelopes map[reflect.Type]reflect.Type
+	schema    func() *Schema
+}
+
+func NewPacketRegistry(title string, fields any, strict bool) *PacketRegistry {
+	registry := &PacketRegistry{
+		Title:     title,
+		Fields:    fields,
+		Strict:    strict,
+		types:     map[string]reflect.Type{},
+		byType:    map[reflect.Type]string{},
+		envelopes: map[reflect.Type]reflect.Type{},
+	}
+	registry.schema = sync.OnceValue(registry.buildSchema)
+	return registry
+}
+
+// Register adds the packet with its wire name. It must be called during
+// package initialization, before the registry is used.
+func (registry *PacketRegistry) Register(name string, packet any) {
+	packetType := reflect.TypeOf(packet)
+	if _, ok := registry.types[name]; ok {
+		panic(fmt.Sprintf("packet %s registered twice", name))
+	}
+	registry.names = append(registry.names, name)
+	registry.types[name] = packetType
+	registry.byType[packetType] = name
+	registry.envelopes[packetType] = registry.envelopeType(packetType)
+}
+
+// envelopeType is the packet as sent on the wire: its type, its fields
+// and the fields shared by the registry.
+func (registry *PacketRegistry) envelopeType(packetType reflect.Type) reflect.Type {
+	fields := []reflect.StructField{{Name: "Type", Type: reflect.TypeOf(""), Tag: `json:"type"`}}
+	for _, structType := range []reflect.Type{packetType, reflect.TypeOf(registry.Fields)} {
+		for i := 0; i < structType.NumField(); i++ {
+			field := structType.Field(i)
+			field.Index, field.Offset = nil, 0
+			fields = append(fields, field)
+		}
+	}
+	return reflect.StructOf(fields)
+}
+
+// Wrap returns the packet in its envelope, ready to be encoded by a codec.
+// fields must be of the type of the registry Fields.
+func (registry *PacketRegistry) Wrap(packet any, fields any) (any, error) {
+	packetType := reflect.TypeOf(packet)
+	envelopeType, ok := registry.envelopes[packetType]
+	if !ok {
+		return nil, fmt.Errorf("unknown packet: %T", packet)
+	}
+	envelope := reflect.New(envelopeType).Elem()
+	envelope.Field(0).SetString(registry.byType[packetType])
+	index := 1
+	for _, value := range []reflect.Value{reflect.ValueOf(packet), reflect.ValueOf(fields)} {
+		for i := 0; i < value.NumField(); i++ {
+			envelope.Field(index).Set(value.Field(i))
+			index++
+		}
+	}
+	return envelope.Interface(), nil
+}
+
+// New returns a pointer to a new packet of the type registered with the name.
+func (registry *PacketRegistry) New(name string) (any, bool) {
+	packetType, ok := registry.types[name]
+	if !ok {
+		return nil, false
+	}
+	return reflect.New(packetType).Interface(), true
+}
+
+// Name returns the wire name of the packet.
+func (registry *PacketRegistry) Name(packet any) (string, bool) {
+	name, ok := registry.byType[reflect.TypeOf(packet)]
+	return name, ok
+}
+
+// Schema returns the JSON Schema of every registered packet.
+func (registry *PacketRegistry) Schema() *Schema {
+	return registry.schema()
+}
+
+// Validate checks a decoded packet against the schema of its type.
+func (registry *PacketRegistry) Validate(name string, packet any) error {
+	packetType, ok := registry.types[name]
+	if !ok {
+		return &SchemaError{Message: fmt.Sprintf("unknown packet %s", name)}
+	}
+	root := registry.Schema()
+	return root.Defs[packetType.Name()].validate(root, "", packet)
+}
+
+func (registry *PacketRegistry) buildSchema() *Schema {
+	builder := schemaBuilder{defs: map[string]*Schema{}, strict: registry.Strict}
+	fields := builder.object(reflect.TypeOf(registry.Fields))
+	root := &Schema{Dialect: schemaDialect, Title: registry.Title, Defs: builder.defs}
+	for _, name := range registry.names {
+		packetType := registry.types[name]
+		packet := builder.object(packetType)
+		packet.Properties["type"] = &Schema{Type: "string", Const: name}
+		packet.order = append([]string{"type"}, packet.order...)
+		packet.Required = append([]string{"type"}, packet.Required...)
+		for _, field := range fields.order {
+			packet.Properties[field] = fields.Properties[field]
+			packet.order = append(packet.order, field)
+		}
+		packet.Required = append(packet.Required, fields.Required...)
+		builder.defs[packetType.Name()] = packet
+		root.AnyOf = append(root.AnyOf, &Schema{Ref: "#/$defs/" + packetType.Name()})
+	}
+	return root
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// schemaVariants lists the implementations of the interfaces used in
+// packets, so that they are described instead of accepting anything.
+var schemaVariants = map[reflect.Type][]any{
+	reflect.TypeOf((*LobbyState)(nil)).Elem(): {
+		PreLobbyState{}, CountdownLobbyState{}, GameLobbyState{}, IntermissionLobbyState{}, ResultsLobbyState{}, ClosedLobbyState{},
+	},
+}
+
+type schemaBuilder struct {
+	defs   map[string]*Schema
+	strict bool
+}
+
+func (builder *schemaBuilder) schemaOf(t reflect.Type) *Schema {
+	switch t {
+	case timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case durationType:
+		return &Schema{Type: "integer"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return &Schema{AnyOf: []*Schema{builder.schemaOf(t.Elem()), {Type: "null"}}}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return builder.object(t)
+		}
+		if _, ok := builder.defs[t.Name()]; !ok {
+			// placeholder, in case the type refers to itself
+			builder.defs[t.Name()] = &Schema{}
+			builder.defs[t.Name()] = builder.object(t)
+		}
+		return &Schema{Ref: "#/$defs/" + t.Name()}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: builder.schemaOf(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: builder.schemaOf(t.Elem())}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Interface:
+		schema := &Schema{}
+		for _, variant := range schemaVariants[t] {
+			schema.AnyOf = append(schema.AnyOf, builder.schemaOf(reflect.TypeOf(variant)))
+		}
+		return schema
+	}
+	panic(fmt.Sprintf("no schema for %v", t))
+}
+
+func (builder *schemaBuilder) object(t reflect.Type) *Schema {
+	schema := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	for _, field := range reflect.VisibleFields(t) {
+		if !field.IsExported() || field.Anonymous {
+			continue
+		}
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		schema.Properties[name] = builder.schemaOf(field.Type)
+		schema.order = append(schema.order, name)
+		if builder.strict && !slices.Contains(strings.Split(options, ","), "omitempty") {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+	return schema
+}
+
+func (schema *Schema) validate(root *Schema, path string, value any) error {
+	if schema.Ref != "" {
+		return root.Defs[strings.TrimPrefix(schema.Ref, "#/$defs/")].validate(root, path, value)
+	}
+	if len(schema.AnyOf) > 0 {
+		var first error
+		for _, variant := range schema.AnyOf {
+			err := variant.validate(root, path, value)
+			if err == nil {
+				return nil
+			}
+			if first == nil && variant.Type != "null" {
+				first = err
+			}
+		}
+		return first
+	}
+	if schema.Const != nil && value != schema.Const {
+		return &SchemaError{Path: path, Message: fmt.Sprintf("expected %v", schema.Const)}
+	}
+	if schema.Type != "" && schema.Type != kindOf(value) &&
+		!(schema.Type == "number" && kindOf(value) == "integer") {
+		return &SchemaError{Path: path, Message: fmt.Sprintf("expected %s, got %s", schema.Type, kindOf(value))}
+	}
+	switch value := value.(type) {
+	case string:
+		if schema.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339, value); err != nil {
+				return &SchemaError{Path: path, Message: "expected a RFC 3339 date-time"}
+			}
+		}
+	case []any:
+		for i, item := range value {
+			if err := schema.Items.validate(root, fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		for _, name := range schema.Required {
+			if _, ok := value[name]; !ok {
+				return &SchemaError{Path: joinPath(path, name), Message: "missing required field"}
+			}
+		}
+		for name, item := range value {
+			property, ok := schema.Properties[name]
+			if !ok {
+				property = schema.AdditionalProperties
+			}
+			if property == nil {
+				continue
+			}
+			if err := property.validate(root, joinPath(path, name), item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func joinPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// kindOf returns the JSON Schema type of a value decoded by any codec.
+func kindOf(value any) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return "integer"
+	case float32:
+		return numberKind(float64(value))
+	case float64:
+		return numberKind(value)
+	case json.Number:
+		if _, err := value.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func numberKind(value float64) string {
+	if value == float64(int64(value)) {
+		return "integer"
+	}
+	return "number"
+}
@@ -0,0 +1,54 @@
+package codeduel
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSchemaValidation(t *testing.T) {
+	_, server := newTestServer(t)
+	owner, _ := createLobby(t, server, "u1")
+	for _, c := range []struct {
+		packet  map[string]any
+		message string
+	}{
+		{map[string]any{"type": "updateSettings", "settings": map[string]any{"maxPlayers": "8"}}, "settings.maxPlayers: expected integer, got string"},
+		{map[string]any{"type": "kick", "userId": 1.5}, "userId: expected integer, got number"},
+	} {
+		owner.send(c.packet)
+		if err := owner.until("error"); err["code"] != "malformed_packet" || err["message"] != c.message {
+			t.Errorf("%v: got %v, want %q", c.packet, err, c.message)
+		}
+	}
+	// valid packets go through to their handler
+	owner.send(map[string]any{"type": "kick", "userId": 4})
+	if err := owner.until("error"); err["code"] != "user_not_found" {
+		t.Fatal(err)
+	}
+}
+
+// TestGeneratedFiles fails when the packets changed without running
+// go generate.
+func TestGeneratedFiles(t *testing.T) {
+	generated := map[string]string{
+		"packets.d.ts": TypeScript(InboundPackets, OutboundPackets),
+	}
+	for name, registry := range map[string]*PacketRegistry{"inbound.schema.json": InboundPackets, "outbound.schema.json": OutboundPackets} {
+		schema, err := json.MarshalIndent(registry.Schema(), "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		generated[name] = string(schema) + "\n"
+	}
+	for name, content := range generated {
+		committed, err := os.ReadFile(filepath.Join("..", "schema", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(committed) != content {
+			t.Errorf("schema/%s is out of date, run go generate ./...", name)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package codeduel
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/xedom/codeduel-lobby/codeduel/utils"
+)
+
+// requestLog records the requests received by fakeBackend as "METHOD path".
+type requestLog struct {
+	mutex    sync.Mutex
+	requests []string
+}
+
+func (log *requestLog) add(r *http.Request) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	log.requests = append(log.requests, r.Method+" "+r.URL.Path)
+}
+
+func (log *requestLog) list() []string {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	return slices.Clone(log.requests)
+}
+
+// recordRequests replaces the backend of the server with one recording its
+// requests.
+func recordRequests(t *testing.T, server *APIServer) *requestLog {
+	requests := &requestLog{}
+	backend := NewBackend(fakeBackend(t, requests).URL, "key")
+	server.Backend = &backend
+	return requests
+}
+
+// fakeBackend authenticates the token "u<id>" as the user with that id and
+// serves a challenge with one public and two hidden test cases. requests,
+// when not nil, records every request.
+func fakeBackend(t *testing.T, requests *requestLog) *httptest.Server {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests != nil {
+			requests.add(r)
+		}
+		switch r.URL.Path {
+		case "/v1/auth/validate_token":
+			var body map[string]string
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			var id int
+			_, _ = fmt.Sscanf(body["token"], "u%d", &id)
+			_ = json.NewEncoder(w).Encode(map[string]any{"id": id, "username": body["token"]})
+		case "/v1/challenge/random":
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"id":              1,
+				"title":           "echo",
+				"testCases":       []map[string]string{{"input": "1", "output": "1"}},
+				"hiddenTestCases": []map[string]string{{"input": "1", "output": "1"}, {"input": "2", "output": "2"}},
+			})
+		default:
+			_ = json.NewEncoder(w).Encode(map[string]any{})
+		}
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+// fakeRunner echoes every input back, so any code passes the tests except
+// "bad", which fails all of them. Each test takes 1.5ms, except with
+// "instant", which takes 0ms, and "untimed", which the runner does not time.
+func fakeRunner(t *testing.T) *httptest.Server {
+	runner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "languages") {
+			_ = json.NewEncoder(w).Encode(map[string]any{"result": []string{"python", "go"}})
+			return
+		}
+		var body struct {
+			Code  string   `json:"code"`
+			Input []string `json:"input"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		result := []map[string]any{}
+		for _, input := range body.Input {
+			output := input
+			if body.Code == "bad" {
+				output = "x"
+			}
+			test := map[string]any{"output": output, "errors": "", "status": 0, "wallTime": 1.5, "cpuTime": 1.25}
+			switch body.Code {
+			case "instant":
+				test["wallTime"], test["cpuTime"] = 0, 0
+			case "untimed":
+				delete(test, "wallTime")
+				delete(test, "cpuTime")
+			}
+			result = append(result, test)
+		}
+		time.Sleep(20 * time.Millisecond)
+		_ = json.NewEncoder(w).Encode(map[string]any{"result": result})
+	}))
+	t.Cleanup(runner.Close)
+	return runner
+}
+
+func newTestServer(t *testing.T) (*APIServer, *httptest.Server) {
+	backendServer, runnerServer := fakeBackend(t, nil), fakeRunner(t)
+	config := &utils.Config{
+		BackendURL:          backendServer.URL,
+		RunnerURL:           runnerServer.URL,
+		PresenceGracePeriod: 30 * time.Second,
+		Countdown:           50 * time.Millisecond,
+		ResultsWindow:       300 * time.Millisecond,
+		Intermission:        300 * time.Millisecond,
+		RunnerTimings:       true,
+		MaxCodeSize:         64 * 1024,
+	}
+	runner := NewRunner(runnerServer.URL)
+	backend := NewBackend(backendServer.URL, "key")
+	server := NewApiServer(config, NewLobbyRegistry(), &runner, &backend)
+	httpServer := httptest.NewServer(server.Router())
+	t.Cleanup(httpServer.Close)
+	return server, httpServer
+}
+
+type testClient struct {
+	*websocket.Conn
+	t *testing.T
+}
+
+func dialLobby(t *testing.T, server *httptest.Server, path string, token string, protocols ...string) *testClient {
+	t.Helper()
+	header := http.Header{}
+	header.Add("Cookie", "access_token="+token)
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = protocols
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+path, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return &testClient{conn, t}
+}
+
+// createLobby connects the owner to a new lobby and returns its id.
+func createLobby(t *testing.T, server *httptest.Server, token string, protocols ...string) (*testClient, string) {
+	t.Helper()
+	owner := dialLobby(t, server, "/create", token, protocols...)
+	return owner, owner.until("lobby")["id"].(string)
+}
+
+// joinLobby connects a new player to the lobby.
+func joinLobby(t *testing.T, server *httptest.Server, id string, token string, protocols ...string) *testClient {
+	t.Helper()
+	player := dialLobby(t, server, "/join/"+id, token, protocols...)
+	player.until("lobby")
+	return player
+}
+
+func (client *testClient) send(packet map[string]any) {
+	client.t.Helper()
+	if err := client.WriteJSON(packet); err != nil {
+		client.t.Fatal(err)
+	}
+}
+
+// until skips the packets received before the first one of the given type.
+func (client *testClient) until(packetType string) map[string]any {
+	client.t.Helper()
+	_ = client.SetReadDeadline(time.Now().Add(8 * time.Second))
+	for {
+		var packet map[string]any
+		if err := client.ReadJSON(&packet); err != nil {
+			client.t.Fatalf("waiting for %s: %v", packetType, err)
+		}
+		if packet["type"] == packetType {
+			return packet
+		}
+	}
+}
+
+// closeReason reads until the connection is closed and returns the close
+// code followed by its message.
+func (client *testClient) closeReason() string {
+	_ = client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		if _, _, err := client.ReadMessage(); err != nil {
+			if closeErr, ok := err.(*websocket.CloseError); ok {
+				return fmt.Sprintf("%d %s", closeErr.Code, closeErr.Text)
+			}
+			return err.Error()
+		}
+	}
+}
+
+func classicSettings(gameDuration int) map[string]any {
+	return map[string]any{"maxPlayers": 8, "gameDuration": gameDuration, "allowedLanguages": []string{"go"}}
+}
+
+// startGame applies the settings and starts the game, waiting for every
+// player to receive the start.
+func startGame(owner *testClient, settings map[string]any, players ...*testClient) {
+	owner.send(map[string]any{"type": "updateSettings", "settings": settings})
+	owner.send(map[string]any{"type": "start"})
+	owner.until("gameStarted")
+	for _, player := range players {
+		player.until("gameStarted")
+	}
+}
+
+func TestCreateLobby(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	owner := dialLobby(t, httpServer, "/create", "u1")
+	lobby := owner.until("lobby")
+	if lobby["owner"].(map[string]any)["id"] != 1.0 {
+		t.Fatal(lobby)
+	}
+	if _, ok := server.Lobbies.Get(lobby["id"].(string)); !ok {
+		t.Fatal("lobby not registered")
+	}
+}
+
+func TestFailedUpgrade(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	get := func(path string, token string) {
+		request, err := http.NewRequest("GET", httpServer.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Add("Cookie", "access_token="+token)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = response.Body.Close()
+	}
+
+	// a request that is not a websocket handshake leaves no lobby behind
+	get("/create", "u1")
+	server.Lobbies.Range(func(lobby *Lobby) bool {
+		t.Error("lobby left after a failed upgrade:", lobby.Id)
+		return true
+	})
+
+	// nor a seat in the lobby it joined
+	_, id := createLobby(t, httpServer, "u1")
+	get("/join/"+id, "u2")
+	player := joinLobby(t, httpServer, id, "u3")
+	player.send(map[string]any{"type": "resync", "requestId": "resync"})
+	if users := player.until("lobby")["users"].(map[string]any); len(users) != 2 || users["2"] != nil {
+		t.Fatal(users)
+	}
+}
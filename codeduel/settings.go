@@ -0,0 +1,125 @@
+package codeduel
+
+import (
+	"slices"
+	"time"
+)
+
+const (
+	defaultMaxPlayers   = 8
+	defaultGameDuration = 15 * time.Minute
+
+	minMaxPlayers   = 1
+	maxMaxPlayers   = 32
+	minGameDuration = time.Minute
+	maxGameDuration = 2 * time.Hour
+)
+
+// Settings are chosen by the owner before the game starts.
+//
+// GameDuration is sent in seconds to clients of ProtocolV1 and in
+// milliseconds to the later versions, the same unit is expected from them.
+// It is rounded down to whole seconds.
+type Settings struct {
+	Mode             string        `json:"mode"`
+	MaxPlayers       int           `json:"maxPlayers"`
+	GameDuration     time.Duration `json:"gameDuration"`
+	AllowedLanguages []string      `json:"allowedLanguages"`
+	// MaxCodeSize is the largest code in bytes accepted by check and submit,
+	// zero means the limit of the server.
+	MaxCodeSize int `json:"maxCodeSize"`
+	// Golf is only used by the golf mode.
+	Golf GolfSettings `json:"golf"`
+	// Teams is only used by the teams mode.
+	Teams TeamSettings `json:"teams"`
+	// Rounds makes the game a match of several rounds. The elimination
+	// mode ignores Rounds.Count and plays until one player is left.
+	Rounds RoundSettings `json:"rounds"`
+	// Elimination is only used by the elimination mode.
+	Elimination EliminationSettings `json:"elimination"`
+}
+
+// normalize returns the settings with the duration in whole seconds,
+// without repeated languages and with the default mode when none is set.
+func (settings Settings) normalize() Settings {
+	if settings.Mode == "" {
+		settings.Mode = defaultMode
+	}
+	if settings.Golf.Unit == "" {
+		settings.Golf.Unit = GolfUnitBytes
+	}
+	if settings.Teams.Count == 0 {
+		settings.Teams.Count = defaultTeamCount
+	}
+	if settings.Teams.Scoring == "" {
+		settings.Teams.Scoring = TeamScoringBest
+	}
+	if settings.Rounds.Count == 0 {
+		settings.Rounds.Count = 1
+	}
+	if len(settings.Elimination.Schedule) == 0 {
+		settings.Elimination.Schedule = []int{1}
+	}
+	settings.GameDuration = settings.GameDuration.Truncate(time.Second)
+	languages := make([]string, 0, len(settings.AllowedLanguages))
+	for _, language := range settings.AllowedLanguages {
+		if !slices.Contains(languages, language) {
+			languages = append(languages, language)
+		}
+	}
+	settings.AllowedLanguages = languages
+	return settings
+}
+
+// validateSettings returns a LobbyError naming the first field out of its
+// bounds.
+func (lobby *Lobby) validateSettings(settings Settings) error {
+	mode, ok := gameModes[settings.Mode]
+	if !ok {
+		return NewLobbyError(ErrorInvalidValue, "mode must be one of %s", gameModeNames())
+	}
+	if _, repeated := mode.(RepeatedMode); repeated && !lobby.timings {
+		return NewLobbyError(ErrorInvalidValue, "mode %s needs a runner reporting timings", settings.Mode)
+	}
+	if settings.MaxPlayers < minMaxPlayers || settings.MaxPlayers > maxMaxPlayers {
+		return NewLobbyError(ErrorInvalidValue, "maxPlayers must be between %d and %d", minMaxPlayers, maxMaxPlayers)
+	}
+	if settings.MaxPlayers < len(lobby.Users) {
+		return NewLobbyError(ErrorInvalidValue, "maxPlayers must be at least the %d users in the lobby", len(lobby.Users))
+	}
+	if settings.GameDuration < minGameDuration || settings.GameDuration > maxGameDuration {
+		return NewLobbyError(ErrorInvalidValue, "gameDuration must be between %v and %v", minGameDuration, maxGameDuration)
+	}
+	if len(settings.AllowedLanguages) == 0 {
+		return NewLobbyError(ErrorInvalidValue, "allowedLanguages must not be empty")
+	}
+	for _, language := range settings.AllowedLanguages {
+		if !slices.Contains(lobby.languages, language) {
+			return NewLobbyError(ErrorInvalidValue, "language %s is not supported", language)
+		}
+	}
+	if settings.MaxCodeSize < 0 || settings.MaxCodeSize > lobby.maxCodeSize {
+		return NewLobbyError(ErrorInvalidValue, "maxCodeSize must be between 0 and %d", lobby.maxCodeSize)
+	}
+	if settings.Golf.Unit != GolfUnitBytes && settings.Golf.Unit != GolfUnitChars {
+		return NewLobbyError(ErrorInvalidValue, "golf.unit must be %s or %s", GolfUnitBytes, GolfUnitChars)
+	}
+	if settings.Teams.Count < 2 || settings.Teams.Count > maxTeamCount {
+		return NewLobbyError(ErrorInvalidValue, "teams.count must be between 2 and %d", maxTeamCount)
+	}
+	if settings.Teams.Scoring != TeamScoringBest && settings.Teams.Scoring != TeamScoringSum {
+		return NewLobbyError(ErrorInvalidValue, "teams.scoring must be %s or %s", TeamScoringBest, TeamScoringSum)
+	}
+	if settings.Rounds.Count < 1 || settings.Rounds.Count > maxRounds {
+		return NewLobbyError(ErrorInvalidValue, "rounds.count must be between 1 and %d", maxRounds)
+	}
+	if len(settings.Elimination.Schedule) > maxMaxPlayers {
+		return NewLobbyError(ErrorInvalidValue, "elimination.schedule must not have more than %d rounds", maxMaxPlayers)
+	}
+	for _, count := range settings.Elimination.Schedule {
+		if count < 1 || count >= maxMaxPlayers {
+			return NewLobbyError(ErrorInvalidValue, "elimination.schedule must eliminate between 1 and %d players per round", maxMaxPlayers-1)
+		}
+	}
+	return nil
+}
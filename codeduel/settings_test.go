@@ -0,0 +1,54 @@
+package codeduel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpdateSettings(t *testing.T) {
+	_, server := newTestServer(t)
+	owner, id := createLobby(t, server, "u1", "codeduel.v2")
+	player := joinLobby(t, server, id, "u2", "codeduel.v2")
+	player.send(map[string]any{"type": "updateSettings", "settings": map[string]any{"maxPlayers": 4, "gameDuration": 60000, "allowedLanguages": []string{"go"}}})
+	if err := player.until("error"); err["code"] != "not_owner" {
+		t.Fatal(err)
+	}
+	for _, invalid := range []map[string]any{
+		{"maxPlayers": 0, "gameDuration": 60000, "allowedLanguages": []string{"go"}},
+		{"maxPlayers": 1, "gameDuration": 60000, "allowedLanguages": []string{"go"}},
+		{"maxPlayers": 4, "gameDuration": 900, "allowedLanguages": []string{"go"}},
+		{"maxPlayers": 4, "gameDuration": 60000, "allowedLanguages": []string{}},
+		{"maxPlayers": 4, "gameDuration": 60000, "allowedLanguages": []string{"cobol"}},
+		{"maxPlayers": 4, "gameDuration": 60000, "allowedLanguages": []string{"go"}, "maxCodeSize": 1 << 30},
+	} {
+		owner.send(map[string]any{"type": "updateSettings", "settings": invalid})
+		if err := owner.until("error"); err["code"] != "invalid_value" {
+			t.Errorf("%v: got %v", invalid, err)
+		}
+	}
+
+	// durations are rounded to the second and languages deduplicated
+	owner.send(map[string]any{"type": "updateSettings", "settings": map[string]any{"maxPlayers": 4, "gameDuration": 90500, "allowedLanguages": []string{"go", "go"}}})
+	settings := player.until("settingsUpdated")["settings"].(map[string]any)
+	if settings["gameDuration"] != 90000.0 || len(settings["allowedLanguages"].([]any)) != 1 {
+		t.Fatal(settings)
+	}
+}
+
+// TestSettingsInSeconds checks that the first protocol reads and writes the
+// durations in seconds.
+func TestSettingsInSeconds(t *testing.T) {
+	_, server := newTestServer(t)
+	owner, _ := createLobby(t, server, "u1")
+	owner.send(map[string]any{"type": "updateSettings", "settings": classicSettings(90)})
+	if settings := owner.until("settingsUpdated")["settings"].(map[string]any); settings["gameDuration"] != 90.0 {
+		t.Fatal(settings)
+	}
+	owner.send(map[string]any{"type": "start"})
+	started := owner.until("gameStarted")
+	startTime, _ := time.Parse(time.RFC3339, started["startTime"].(string))
+	deadline, _ := time.Parse(time.RFC3339, started["deadline"].(string))
+	if deadline.Sub(startTime) != 90*time.Second {
+		t.Fatal(started)
+	}
+}
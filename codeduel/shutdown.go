@@ -0,0 +1,82 @@
+package codeduel
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var ErrShuttingDown = errors.New("server shutting down")
+
+const (
+	// httpShutdownShare is the part of the shutdown timeout kept for the
+	// http server, whatever the lobbies and their games take.
+	httpShutdownShare = 4
+)
+
+// Shutdown stops accepting new lobbies, disconnects every client with a
+// reconnect hint, finalizes the running games with the backend and then
+// stops the http server. Everything has to complete within timeout, the
+// http server being left at least 1/httpShutdownShare of it.
+func (s *APIServer) Shutdown(server *http.Server, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline.Add(-timeout/httpShutdownShare))
+	defer cancel()
+
+	s.starting.Lock()
+	s.draining.Store(true)
+	s.starting.Unlock()
+	// a busy lobby must not hold up the others
+	var stopping sync.WaitGroup
+	s.Lobbies.Range(func(lobby *Lobby) bool {
+		stopping.Add(1)
+		go func() {
+			defer stopping.Done()
+			err := lobby.DoContext(ctx, func() {
+				lobby.DisconnectAll(ServiceRestart, "server shutting down, reconnect later")
+				lobby.EndGame(ErrShuttingDown)
+			})
+			if errors.Is(err, context.DeadlineExceeded) {
+				log.Printf("[API] Timed out while stopping lobby %v", lobby.Id)
+			}
+		}()
+		return true
+	})
+	stopping.Wait()
+	// games in the results window do not need to wait for late reconnects
+	s.cancelClosing()
+
+	finalized := make(chan struct{})
+	go func() {
+		s.games.Wait()
+		close(finalized)
+	}()
+	select {
+	case <-finalized:
+		log.Print("[API] All games finalized")
+	case <-ctx.Done():
+		log.Print("[API] Timed out while finalizing games")
+	}
+
+	httpCtx, cancelHttp := context.WithDeadline(context.Background(), deadline)
+	defer cancelHttp()
+	if err := server.Shutdown(httpCtx); err != nil {
+		log.Printf("[API] error while shutting down http server: %v", err)
+	}
+}
+
+// EndGame interrupts the countdown or the running game, HandleGame then
+// takes care of finalizing it.
+func (lobby *Lobby) EndGame(cause error) {
+	switch state := lobby.State.(type) {
+	case *CountdownLobbyState:
+		state.context(cause)
+	case *GameLobbyState:
+		state.match(cause)
+	case *IntermissionLobbyState:
+		state.match(cause)
+	}
+}
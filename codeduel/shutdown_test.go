@@ -0,0 +1,126 @@
+package codeduel
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	requests := recordRequests(t, server)
+	owner, id := createLobby(t, httpServer, "u1")
+	player := joinLobby(t, httpServer, id, "u2")
+	startGame(owner, classicSettings(60), player)
+
+	start := time.Now()
+	server.Shutdown(httpServer.Config, 2*time.Second)
+	if elapsed := time.Since(start); elapsed >= 2*time.Second {
+		t.Fatal("shutdown timed out after", elapsed)
+	}
+	// the game was finalized before Shutdown returned
+	if !slices.Contains(requests.list(), "PATCH /v1/game/"+id+"/endgame") {
+		t.Fatal(requests.list())
+	}
+	if reason := owner.closeReason(); !strings.HasPrefix(reason, "1012 ") {
+		t.Fatal(reason)
+	}
+}
+
+func TestDoContextGivesUp(t *testing.T) {
+	lobby := NewLobby(&User{Id: 1}, []string{"go"}, false, 1024)
+	release := make(chan struct{})
+	defer close(release)
+	if err := lobby.Post(func() { <-release }); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := lobby.DoContext(ctx, func() {}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal(err)
+	}
+}
+
+func TestShutdownKeepsTimeForHTTP(t *testing.T) {
+	server, _ := newTestServer(t)
+	// a game that never finalizes uses up the time of the games
+	server.games.Add(1)
+	defer server.games.Done()
+	started := make(chan struct{})
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(800 * time.Millisecond)
+	}))
+	defer httpServer.Close()
+	go func() {
+		if response, err := http.Get(httpServer.URL); err == nil {
+			_ = response.Body.Close()
+		}
+	}()
+	<-started
+
+	start := time.Now()
+	server.Shutdown(httpServer.Config, time.Second)
+	// the request in flight ended before the deadline of the http server
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Fatal("shutdown timed out after", elapsed)
+	}
+}
+
+func TestJoinWhileDraining(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	_, id := createLobby(t, httpServer, "u1")
+	server.draining.Store(true)
+	if reason := rejection(t, httpServer, "/join/"+id, "u2"); reason != "1012 server shutting down" {
+		t.Fatal(reason)
+	}
+}
+
+func TestStartWhileDraining(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	// the challenge is fetched once Shutdown has taken its snapshot
+	fetching, release := make(chan struct{}), make(chan struct{})
+	target, _ := url.Parse(fakeBackend(t, nil).URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/challenge/random" {
+			close(fetching)
+			<-release
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer backendServer.Close()
+	backend := NewBackend(backendServer.URL, "key")
+	server.Backend = &backend
+
+	_, id := createLobby(t, httpServer, "u1")
+	lobby, _ := server.Lobbies.Get(id)
+	started := make(chan error, 1)
+	go func() {
+		started <- server.StartLobby(lobby, context.Background())
+	}()
+	<-fetching
+	stopped := make(chan struct{})
+	go func() {
+		server.Shutdown(httpServer.Config, 2*time.Second)
+		close(stopped)
+	}()
+	<-stopped
+	close(release)
+
+	if err := <-started; !errors.Is(err, ErrShuttingDown) {
+		t.Fatal(err)
+	}
+	_ = lobby.Read(func() {
+		if _, ok := lobby.State.(*PreLobbyState); !ok {
+			t.Errorf("game started while draining: %T", lobby.State)
+		}
+	})
+}
@@ -0,0 +1,203 @@
+package codeduel
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	StatePreLobby  = "preLobby"
+	StateCountdown = "countdown"
+	StateGame      = "game"
+	// StateIntermission is the pause between the rounds of a match.
+	StateIntermission = "intermission"
+	StateResults      = "results"
+	StateClosed       = "closed"
+)
+
+// LobbyState is one phase of the lobby lifecycle:
+// PreLobby → Countdown → InGame → Results → Closed, with an Intermission
+// between the rounds of a match.
+type LobbyState interface {
+	StateType() string
+	// Accepts reports whether the inbound packet can be handled in this phase.
+	Accepts(packet any) bool
+}
+
+var lobbyTransitions = map[string][]string{
+	StatePreLobby:     {StateCountdown, StateClosed},
+	StateCountdown:    {StateGame, StateClosed},
+	StateGame:         {StateIntermission, StateResults, StateClosed},
+	StateIntermission: {StateGame, StateResults, StateClosed},
+	StateResults:      {StateClosed},
+	StateClosed:       {},
+}
+
+// TransitionError is returned when a state change is not allowed by the
+// lobby lifecycle.
+type TransitionError struct {
+	From string
+	To   string
+}
+
+func (err *TransitionError) Error() string {
+	return fmt.Sprintf("lobby cannot go from %s to %s", err.From, err.To)
+}
+
+// StateError is returned when an action is not allowed in the current phase.
+type StateError struct {
+	State  string
+	Action string
+}
+
+func (err *StateError) Error() string {
+	return fmt.Sprintf("cannot %s while the lobby is in %s", err.Action, err.State)
+}
+
+type PreLobbyState struct {
+	Type  string   `json:"type"`
+	Ready []UserId `json:"ready"`
+}
+
+type CountdownLobbyState struct {
+	Type      string    `json:"type"`
+	StartTime time.Time `json:"startTime"`
+	challenge Challenge
+	context   context.CancelCauseFunc
+}
+
+// GameLobbyState is a round of the match, registered as its own game with
+// the backend under GameId.
+type GameLobbyState struct {
+	Type        string                        `json:"type"`
+	Round       int                           `json:"round"`
+	Rounds      int                           `json:"rounds"`
+	GameId      string                        `json:"gameId"`
+	Challenge   Challenge                     `json:"challenge"`
+	StartTime   time.Time                     `json:"startTime"`
+	Deadline    time.Time                     `json:"deadline"`
+	UsersState  map[UserId]UserGameLobbyState `json:"usersState"`
+	SubmitCount int                           `json:"submitCount"`
+	// Eliminated are the spectators of the elimination mode, with the round
+	// they were eliminated after.
+	Eliminated map[UserId]int `json:"eliminated,omitempty"`
+	// context ends the round, match ends every round left
+	context context.CancelCauseFunc
+	match   context.CancelCauseFunc
+}
+
+// IntermissionLobbyState follows a round when more are left to play.
+type IntermissionLobbyState struct {
+	Type        string             `json:"type"`
+	Round       int                `json:"round"`
+	Rounds      int                `json:"rounds"`
+	Leaderboard []LeaderboardEntry `json:"leaderboard"`
+	Teams       []TeamEntry        `json:"teams,omitempty"`
+	Scoreboard  []ScoreboardEntry  `json:"scoreboard"`
+	NextRoundAt time.Time          `json:"nextRoundAt"`
+	eliminated  map[UserId]int
+	match       context.CancelCauseFunc
+}
+
+type ResultsLobbyState struct {
+	Type        string             `json:"type"`
+	Game        *GameLobbyState    `json:"game"`
+	Leaderboard []LeaderboardEntry `json:"leaderboard"`
+	Teams       []TeamEntry        `json:"teams,omitempty"`
+	// Scoreboard is only set for matches of more than one round.
+	Scoreboard []ScoreboardEntry `json:"scoreboard,omitempty"`
+	ClosesAt   time.Time         `json:"closesAt"`
+}
+
+type ClosedLobbyState struct {
+	Type string `json:"type"`
+}
+
+func NewPreLobbyState() *PreLobbyState {
+	return &PreLobbyState{Type: StatePreLobby, Ready: []UserId{}}
+}
+
+func (state *PreLobbyState) StateType() string { return StatePreLobby }
+
+func (state *PreLobbyState) Accepts(packet any) bool {
+	switch packet.(type) {
+	case *PacketInSettings, *PacketInUserStatus, *PacketInStartLobby, *PacketInLock,
+		*PacketInSetPassword, *PacketInSetInvites, *PacketInJoinTeam, *PacketInBalanceTeams, *PacketInDelete, *PacketInReady, *PacketInKick, *PacketInTransferOwnership:
+		return true
+	}
+	return false
+}
+
+func (state *CountdownLobbyState) StateType() string { return StateCountdown }
+
+func (state *CountdownLobbyState) Accepts(packet any) bool {
+	_, ok := packet.(*PacketInTransferOwnership)
+	return ok
+}
+
+func (state *GameLobbyState) StateType() string { return StateGame }
+
+func (state *GameLobbyState) Accepts(packet any) bool {
+	switch packet.(type) {
+	case *PacketInCheck, *PacketInSubmit, *PacketInTransferOwnership:
+		return true
+	}
+	return false
+}
+
+func (state *IntermissionLobbyState) StateType() string { return StateIntermission }
+
+func (state *IntermissionLobbyState) Accepts(packet any) bool {
+	_, ok := packet.(*PacketInTransferOwnership)
+	return ok
+}
+
+func (state *ResultsLobbyState) StateType() string { return StateResults }
+
+func (state *ResultsLobbyState) Accepts(any) bool { return false }
+
+func (state *ClosedLobbyState) StateType() string { return StateClosed }
+
+func (state *ClosedLobbyState) Accepts(any) bool { return false }
+
+// SetState moves the lobby to the next phase if the lifecycle allows it.
+func (lobby *Lobby) SetState(state LobbyState) error {
+	from, to := lobby.State.StateType(), state.StateType()
+	if !slices.Contains(lobbyTransitions[from], to) {
+		return &TransitionError{From: from, To: to}
+	}
+	lobby.State = state
+	lobby.reindex()
+	return nil
+}
+
+// Accept returns a StateError if the packet cannot be handled in the
+// current phase, or a LobbyError if the user is no longer a member.
+func (lobby *Lobby) Accept(user *User, packet any) error {
+	if err := lobby.checkMember(user); err != nil {
+		return err
+	}
+	if lobby.State.Accepts(packet) {
+		return nil
+	}
+	action := strings.TrimPrefix(reflect.TypeOf(packet).Elem().Name(), "PacketIn")
+	return &StateError{State: lobby.State.StateType(), Action: "handle " + action}
+}
+
+func (lobby *Lobby) preLobby(action string) (*PreLobbyState, error) {
+	if state, ok := lobby.State.(*PreLobbyState); ok {
+		return state, nil
+	}
+	return nil, &StateError{State: lobby.State.StateType(), Action: action}
+}
+
+func (lobby *Lobby) game(action string) (*GameLobbyState, error) {
+	if state, ok := lobby.State.(*GameLobbyState); ok {
+		return state, nil
+	}
+	return nil, &StateError{State: lobby.State.StateType(), Action: action}
+}
@@ -0,0 +1,53 @@
+package codeduel
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestGameFlow(t *testing.T) {
+	_, server := newTestServer(t)
+	owner, id := createLobby(t, server, "u1")
+	player := joinLobby(t, server, id, "u2")
+	owner.send(map[string]any{"type": "updateSettings", "settings": classicSettings(60)})
+	owner.send(map[string]any{"type": "start"})
+	owner.until("countdown")
+	owner.until("gameStarted")
+	player.until("gameStarted")
+
+	player.send(map[string]any{"type": "check", "code": "ok", "language": "go"})
+	player.until("checkResult")
+	owner.send(map[string]any{"type": "submit", "code": "ok", "language": "go"})
+	owner.until("submitResult")
+	player.send(map[string]any{"type": "submit", "code": "bad", "language": "go"})
+	player.until("submitResult")
+
+	// the game ends as soon as everybody submitted
+	ended := owner.until("gameEnded")
+	leaderboard := ended["leaderboard"].([]any)
+	if leaderboard[0].(map[string]any)["user"].(map[string]any)["id"] != 1.0 || leaderboard[1].(map[string]any)["rank"] != 2.0 {
+		t.Fatal(ended)
+	}
+	reconnected := dialLobby(t, server, "/connect/"+id, "u2")
+	if state := reconnected.until("lobby")["state"].(map[string]any); state["type"] != StateResults {
+		t.Fatal(state)
+	}
+}
+
+func TestStateTransitions(t *testing.T) {
+	lobby := NewLobby(&User{Id: 1}, []string{"go"}, false, 1024)
+	err := lobby.Call(func() error {
+		return lobby.SetState(&ResultsLobbyState{Type: StateResults})
+	})
+	var transitionErr *TransitionError
+	if !errors.As(err, &transitionErr) || transitionErr.From != StatePreLobby || transitionErr.To != StateResults {
+		t.Fatal(err)
+	}
+	err = lobby.Call(func() error {
+		return lobby.Accept(lobby.Owner, &PacketInSubmit{})
+	})
+	var stateErr *StateError
+	if !errors.As(err, &stateErr) || stateErr.State != StatePreLobby {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,224 @@
+package codeduel
+
+import (
+	"slices"
+	"sort"
+)
+
+const (
+	TeamScoringBest = "best"
+	TeamScoringSum  = "sum"
+
+	defaultTeamCount = 2
+	maxTeamCount     = 8
+)
+
+// TeamSettings are the options of the teams mode.
+type TeamSettings struct {
+	// Count is the number of teams, numbered from 1.
+	Count int `json:"count"`
+	// Scoring is TeamScoringBest to score a team with its best member, or
+	// TeamScoringSum to add the scores of the members.
+	Scoring string `json:"scoring"`
+}
+
+// TeamEntry is the final standing of a team. Score is the number of passed
+// tests, SubmittedAfter is the one of the best member with TeamScoringBest.
+type TeamEntry struct {
+	Rank           int      `json:"rank"`
+	Team           int      `json:"team"`
+	Members        []UserId `json:"members"`
+	Score          int      `json:"score"`
+	SubmittedAfter *int64   `json:"submittedAfter"`
+}
+
+// TeamGameMode is implemented by the modes where users play in teams.
+type TeamGameMode interface {
+	GameMode
+	// TeamLeaderboard ranks the teams from the leaderboard of the users.
+	TeamLeaderboard(settings TeamSettings, teams map[UserId]int, leaderboard []LeaderboardEntry) []TeamEntry
+}
+
+// TeamMode follows the classic rules, with the users split in teams.
+type TeamMode struct {
+	ClassicMode
+}
+
+func (TeamMode) Name() string { return "teams" }
+
+func (TeamMode) Id() int { return 4 }
+
+func (TeamMode) TeamLeaderboard(settings TeamSettings, teams map[UserId]int, leaderboard []LeaderboardEntry) []TeamEntry {
+	entries := make([]TeamEntry, 0, settings.Count)
+	for team := 1; team <= settings.Count; team++ {
+		entry := TeamEntry{Team: team, Members: []UserId{}}
+		var best *LeaderboardEntry
+		for i, member := range leaderboard {
+			if teams[member.User.Id] != team {
+				continue
+			}
+			entry.Members = append(entry.Members, member.User.Id)
+			entry.Score += member.PassedTests
+			if best == nil || compareEntries(member, *best) < 0 {
+				best = &leaderboard[i]
+			}
+		}
+		slices.Sort(entry.Members)
+		if settings.Scoring == TeamScoringBest {
+			entry.Score = 0
+			if best != nil {
+				entry.Score = best.PassedTests
+				entry.SubmittedAfter = best.SubmittedAfter
+			}
+		}
+		entries = append(entries, entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return compareTeams(entries[i], entries[j]) < 0
+	})
+	for i := range entries {
+		if i > 0 && compareTeams(entries[i-1], entries[i]) == 0 {
+			entries[i].Rank = entries[i-1].Rank
+		} else {
+			entries[i].Rank = i + 1
+		}
+	}
+	return entries
+}
+
+// compareTeams ranks the highest scores first, then the earliest submissions.
+func compareTeams(a, b TeamEntry) int {
+	if a.Score != b.Score {
+		return b.Score - a.Score
+	}
+	switch {
+	case a.SubmittedAfter == nil && b.SubmittedAfter == nil:
+		return 0
+	case a.SubmittedAfter == nil:
+		return 1
+	case b.SubmittedAfter == nil:
+		return -1
+	case *a.SubmittedAfter < *b.SubmittedAfter:
+		return -1
+	case *a.SubmittedAfter > *b.SubmittedAfter:
+		return 1
+	}
+	return 0
+}
+
+// teamMode returns the mode of the lobby if users play in teams.
+func (lobby *Lobby) teamMode() (TeamGameMode, bool) {
+	mode, ok := lobby.mode().(TeamGameMode)
+	return mode, ok
+}
+
+// assignTeams drops the assignments of users that left or of teams that no
+// longer exist, and puts the users without a team in the smallest one.
+// Without teams it clears every assignment.
+func (lobby *Lobby) assignTeams() {
+	if _, ok := lobby.teamMode(); !ok {
+		if len(lobby.teams) > 0 {
+			lobby.teams = map[UserId]int{}
+			lobby.broadcastTeams()
+		}
+		return
+	}
+	changed := false
+	for userId, team := range lobby.teams {
+		if _, ok := lobby.Users[userId]; !ok || team > lobby.Settings.Teams.Count {
+			delete(lobby.teams, userId)
+			changed = true
+		}
+	}
+	for _, user := range lobby.usersByJoinTime() {
+		if _, ok := lobby.teams[user.Id]; !ok {
+			lobby.teams[user.Id] = lobby.smallestTeam()
+			changed = true
+		}
+	}
+	if changed {
+		lobby.broadcastTeams()
+	}
+}
+
+// JoinTeam moves the user to the team, teams cannot hold more than their
+// share of the players.
+func (lobby *Lobby) JoinTeam(user *User, team int) error {
+	if _, err := lobby.preLobby("join a team"); err != nil {
+		return err
+	}
+	if _, ok := lobby.teamMode(); !ok {
+		return NewLobbyError(ErrorInvalidValue, "the lobby is not playing in teams")
+	}
+	settings := lobby.Settings.Teams
+	if team < 1 || team > settings.Count {
+		return NewLobbyError(ErrorInvalidValue, "team must be between 1 and %d", settings.Count)
+	}
+	if lobby.teams[user.Id] == team {
+		return nil
+	}
+	teamSize := (lobby.Settings.MaxPlayers + settings.Count - 1) / settings.Count
+	if lobby.teamSizes()[team] >= teamSize {
+		return NewLobbyError(ErrorInvalidValue, "team %d is full", team)
+	}
+	lobby.teams[user.Id] = team
+	lobby.broadcastTeams()
+	return nil
+}
+
+// BalanceTeams spreads the users evenly between the teams, in the order
+// they joined.
+func (lobby *Lobby) BalanceTeams() error {
+	if _, err := lobby.preLobby("balance the teams"); err != nil {
+		return err
+	}
+	if _, ok := lobby.teamMode(); !ok {
+		return NewLobbyError(ErrorInvalidValue, "the lobby is not playing in teams")
+	}
+	lobby.teams = map[UserId]int{}
+	for i, user := range lobby.usersByJoinTime() {
+		lobby.teams[user.Id] = i%lobby.Settings.Teams.Count + 1
+	}
+	lobby.broadcastTeams()
+	return nil
+}
+
+func (lobby *Lobby) usersByJoinTime() []*User {
+	users := make([]*User, 0, len(lobby.Users))
+	for _, user := range lobby.Users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if !users[i].joinedAt.Equal(users[j].joinedAt) {
+			return users[i].joinedAt.Before(users[j].joinedAt)
+		}
+		return users[i].Id < users[j].Id
+	})
+	return users
+}
+
+func (lobby *Lobby) teamSizes() map[int]int {
+	sizes := map[int]int{}
+	for _, team := range lobby.teams {
+		sizes[team]++
+	}
+	return sizes
+}
+
+// smallestTeam returns the team with the fewest members, the first on ties.
+func (lobby *Lobby) smallestTeam() int {
+	sizes := lobby.teamSizes()
+	smallest := 1
+	for team := 2; team <= lobby.Settings.Teams.Count; team++ {
+		if sizes[team] < sizes[smallest] {
+			smallest = team
+		}
+	}
+	return smallest
+}
+
+func (lobby *Lobby) broadcastTeams() {
+	lobby.BroadcastPacket(PacketOutTeamsUpdated{
+		Teams: lobby.teams,
+	})
+}
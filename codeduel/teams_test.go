@@ -0,0 +1,68 @@
+package codeduel
+
+import (
+	"testing"
+)
+
+func TestTeamLeaderboard(t *testing.T) {
+	after := func(milliseconds int64) *int64 { return &milliseconds }
+	leaderboard := []LeaderboardEntry{
+		{User: &User{Id: 1}, Submitted: true, PassedTests: 2, SubmittedAfter: after(3000)},
+		{User: &User{Id: 2}, Submitted: true, PassedTests: 2, SubmittedAfter: after(1000)},
+		{User: &User{Id: 3}, Submitted: true, PassedTests: 1, SubmittedAfter: after(500)},
+		{User: &User{Id: 4}},
+	}
+	teams := map[UserId]int{1: 1, 2: 2, 3: 1, 4: 2}
+
+	// the best member scores for the team, the earliest breaks the tie
+	best := TeamMode{}.TeamLeaderboard(TeamSettings{Count: 2, Scoring: TeamScoringBest}, teams, leaderboard)
+	if best[0].Team != 2 || best[0].Score != 2 || best[1].Score != 2 || best[1].Rank != 2 {
+		t.Fatal(best)
+	}
+	// the sum counts every member
+	sum := TeamMode{}.TeamLeaderboard(TeamSettings{Count: 2, Scoring: TeamScoringSum}, teams, leaderboard)
+	if sum[0].Team != 1 || sum[0].Score != 3 || sum[1].Score != 2 {
+		t.Fatal(sum)
+	}
+}
+
+func TestTeamMode(t *testing.T) {
+	_, server := newTestServer(t)
+	owner, id := createLobby(t, server, "u1")
+	second := joinLobby(t, server, id, "u2")
+	third := joinLobby(t, server, id, "u3")
+	second.send(map[string]any{"type": "joinTeam", "team": 1})
+	if err := second.until("error"); err["code"] != "invalid_value" {
+		t.Fatal(err)
+	}
+
+	// the users are assigned to the smallest team by join time
+	owner.send(map[string]any{"type": "updateSettings", "settings": map[string]any{"mode": "teams", "maxPlayers": 4, "gameDuration": 60, "allowedLanguages": []string{"go"}, "teams": map[string]any{"count": 2, "scoring": "sum"}}})
+	teams := owner.until("teamsUpdated")["teams"].(map[string]any)
+	if teams["1"] != 1.0 || teams["2"] != 2.0 || teams["3"] != 1.0 {
+		t.Fatal(teams)
+	}
+	third.send(map[string]any{"type": "joinTeam", "team": 2})
+	if teams := owner.until("teamsUpdated")["teams"].(map[string]any); teams["3"] != 2.0 {
+		t.Fatal(teams)
+	}
+	second.send(map[string]any{"type": "balanceTeams"})
+	if err := second.until("error"); err["code"] != "not_owner" {
+		t.Fatal(err)
+	}
+
+	owner.send(map[string]any{"type": "start"})
+	owner.until("gameStarted")
+	for _, player := range []*testClient{owner, second, third} {
+		player.send(map[string]any{"type": "submit", "code": "ok", "language": "go"})
+		player.until("submitResult")
+	}
+	ended := owner.until("gameEnded")
+	results := ended["teams"].([]any)
+	if first := results[0].(map[string]any); first["team"] != 2.0 || first["score"] != 4.0 || results[1].(map[string]any)["score"] != 2.0 {
+		t.Fatal(results)
+	}
+	if ended["leaderboard"].([]any)[0].(map[string]any)["team"] == nil {
+		t.Fatal(ended)
+	}
+}
@@ -0,0 +1,97 @@
+package codeduel
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// TypeScript renders the definitions of the packets of the registries, the
+// same types described by their JSON Schema.
+func TypeScript(registries ...*PacketRegistry) string {
+	var builder strings.Builder
+	builder.WriteString("// Code generated by go generate; DO NOT EDIT.\n")
+	written := map[string]bool{}
+	for _, registry := range registries {
+		root := registry.Schema()
+		names := make([]string, 0, len(root.Defs))
+		for name := range root.Defs {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			if written[name] {
+				continue
+			}
+			written[name] = true
+			builder.WriteString("\n")
+			builder.WriteString(typeScriptDeclaration(name, root.Defs[name]))
+		}
+		builder.WriteString(fmt.Sprintf("\nexport type %s = %s;\n", registry.Title, typeScriptType(&Schema{AnyOf: root.AnyOf})))
+	}
+	return builder.String()
+}
+
+func typeScriptDeclaration(name string, schema *Schema) string {
+	if schema.Type != "object" || schema.Properties == nil {
+		return fmt.Sprintf("export type %s = %s;\n", name, typeScriptType(schema))
+	}
+	return fmt.Sprintf("export interface %s %s\n", name, typeScriptObject(schema, ""))
+}
+
+func typeScriptObject(schema *Schema, indent string) string {
+	var builder strings.Builder
+	builder.WriteString("{\n")
+	for _, property := range schema.order {
+		optional := "?"
+		if slices.Contains(schema.Required, property) {
+			optional = ""
+		}
+		propertyType := typeScriptType(schema.Properties[property])
+		if nested := schema.Properties[property]; nested.Type == "object" && nested.Properties != nil {
+			propertyType = typeScriptObject(nested, indent+"  ")
+		}
+		builder.WriteString(fmt.Sprintf("%s  %s%s: %s;\n", indent, property, optional, propertyType))
+	}
+	builder.WriteString(indent + "}")
+	return builder.String()
+}
+
+func typeScriptType(schema *Schema) string {
+	if schema.Ref != "" {
+		return strings.TrimPrefix(schema.Ref, "#/$defs/")
+	}
+	if len(schema.AnyOf) > 0 {
+		variants := make([]string, 0, len(schema.AnyOf))
+		for _, variant := range schema.AnyOf {
+			variants = append(variants, typeScriptType(variant))
+		}
+		return strings.Join(variants, " | ")
+	}
+	if schema.Const != nil {
+		literal, _ := json.Marshal(schema.Const)
+		return string(literal)
+	}
+	switch schema.Type {
+	case "string", "boolean", "null":
+		return schema.Type
+	case "integer", "number":
+		return "number"
+	case "array":
+		items := typeScriptType(schema.Items)
+		if len(schema.Items.AnyOf) > 0 {
+			items = "(" + items + ")"
+		}
+		return items + "[]"
+	case "object":
+		if schema.Properties != nil {
+			return typeScriptObject(schema, "")
+		}
+		if schema.AdditionalProperties != nil {
+			return fmt.Sprintf("Record<string, %s>", typeScriptType(schema.AdditionalProperties))
+		}
+		return "Record<string, unknown>"
+	}
+	return "unknown"
+}
@@ -0,0 +1,78 @@
+package codeduel
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// uploadRequest is the body of an upload, the same fields as the packet.
+type uploadRequest struct {
+	Code      string `json:"code"`
+	Language  string `json:"language"`
+	RequestId string `json:"requestId,omitempty"`
+}
+
+// uploadSubmission submits code through plain HTTP, for clients that would
+// rather not send large code over the websocket. It goes through the same
+// path as the submit packet, the result is returned and also sent to the
+// connection of the user.
+func (s *APIServer) uploadSubmission(response http.ResponseWriter, request *http.Request) {
+	user, err := s.GetUser(request)
+	if err != nil {
+		writeHttpError(response, http.StatusUnauthorized, PacketOutError{Code: ErrorNotAuthorized, Message: err.Error()})
+		return
+	}
+	lobby, ok := s.Lobbies.Get(mux.Vars(request)["lobby"])
+	if !ok {
+		writeHttpError(response, http.StatusNotFound, PacketOutError{Code: ErrorLobbyNotFound, Message: "lobby not found"})
+		return
+	}
+	var member *User
+	if err := lobby.Read(func() { member = lobby.GetUser(user) }); err != nil || member == nil {
+		writeHttpError(response, http.StatusForbidden, PacketOutError{Code: ErrorNotMember, Message: "you are not in the lobby"})
+		return
+	}
+
+	var upload uploadRequest
+	request.Body = http.MaxBytesReader(response, request.Body, s.maxPacketSize())
+	if err := json.NewDecoder(request.Body).Decode(&upload); err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			writeHttpError(response, http.StatusRequestEntityTooLarge, PacketOutError{Code: ErrorCodeTooLarge, Message: "upload too large"})
+			return
+		}
+		writeHttpError(response, http.StatusBadRequest, PacketOutError{Code: ErrorMalformedPacket, Message: err.Error()})
+		return
+	}
+
+	header := PacketHeader{Type: "submit", RequestId: upload.RequestId}
+	result, err := s.submit(PacketInSubmit{Code: upload.Code, Language: upload.Language}, header, lobby, member)
+	if err != nil {
+		code := ErrorCodeOf(err)
+		message := err.Error()
+		if code == ErrorInternal {
+			log.Printf("error while uploading submission of user %v: %v\n", member.Id, err)
+			message = "internal server error"
+		}
+		writeHttpError(response, httpStatusOf(code), PacketOutError{
+			RequestId:  upload.RequestId,
+			Code:       code,
+			Message:    message,
+			PacketType: header.Type,
+		})
+		return
+	}
+	response.Header().Add("Content-Type", "application/json")
+	response.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(response).Encode(result)
+}
+
+func writeHttpError(response http.ResponseWriter, status int, packet PacketOutError) {
+	response.Header().Add("Content-Type", "application/json")
+	response.WriteHeader(status)
+	_ = json.NewEncoder(response).Encode(packet)
+}
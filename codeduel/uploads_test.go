@@ -0,0 +1,77 @@
+package codeduel
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func upload(t *testing.T, server *httptest.Server, id string, token string, body string) (int, map[string]any) {
+	t.Helper()
+	request, err := http.NewRequest("POST", server.URL+"/lobbies/"+id+"/submissions", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Add("Cookie", "access_token="+token)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var result map[string]any
+	_ = json.NewDecoder(response.Body).Decode(&result)
+	return response.StatusCode, result
+}
+
+func TestLargeCode(t *testing.T) {
+	_, server := newTestServer(t)
+	owner, id := createLobby(t, server, "u1")
+	player := joinLobby(t, server, id, "u2")
+	startGame(owner, map[string]any{"maxPlayers": 8, "gameDuration": 60, "allowedLanguages": []string{"go"}, "maxCodeSize": 64 * 1024}, player)
+
+	// packets bigger than the websocket frames but within the code size
+	owner.send(map[string]any{"type": "check", "code": strings.Repeat("a\n", 10000), "language": "go"})
+	owner.until("checkResult")
+	owner.send(map[string]any{"type": "check", "code": strings.Repeat("a", 70000), "language": "go", "requestId": "large"})
+	if err := owner.until("error"); err["code"] != "code_too_large" || err["requestId"] != "large" {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		token  string
+		body   string
+		status int
+	}{
+		{"u2", `{"code":"` + strings.Repeat("b", 70000) + `","language":"go"}`, http.StatusRequestEntityTooLarge},
+		{"u2", `{"code":"` + strings.Repeat("b", 400000) + `","language":"go"}`, http.StatusRequestEntityTooLarge},
+		{"u2", `{"code":`, http.StatusBadRequest},
+	} {
+		if status, body := upload(t, server, id, c.token, c.body); status != c.status {
+			t.Errorf("%s uploading %d bytes: got %d %v, want %d", c.token, len(c.body), status, body, c.status)
+		}
+	}
+	// the same code as on the websocket
+	if status, body := upload(t, server, id, "u9", `{"code":"x","language":"go"}`); status != http.StatusForbidden || body["code"] != string(ErrorNotMember) {
+		t.Fatal(status, body)
+	}
+	status, result := upload(t, server, id, "u2", `{"code":"`+strings.Repeat("b", 50000)+`","language":"go","requestId":"upload"}`)
+	if status != http.StatusOK || result["requestId"] != "upload" || len(result["result"].([]any)) != 2 {
+		t.Fatal(status, result)
+	}
+	// the result also reaches the connection of the user
+	if submitted := player.until("submitResult"); submitted["requestId"] != "upload" {
+		t.Fatal(submitted)
+	}
+	if status, body := upload(t, server, id, "u2", `{"code":"x","language":"go"}`); status != http.StatusConflict || body["code"] != "already_submitted" {
+		t.Fatal(status, body)
+	}
+
+	// packets above the code size close the connection, which may be reset
+	// before the close frame is read
+	_ = owner.WriteJSON(map[string]any{"type": "check", "code": strings.Repeat("a", 200000), "language": "go"})
+	if reason := owner.closeReason(); !strings.HasPrefix(reason, "1009") && !strings.Contains(reason, "reset by peer") {
+		t.Fatal(reason)
+	}
+}
@@ -1,15 +1,19 @@
 package codeduel
 
-import "github.com/gorilla/websocket"
+import "time"
 
 type UserId int32
 
 type User struct {
-	Id              UserId          `json:"id"`
-	Username        string          `json:"username"`
-	Name            string          `json:"name"`
-	Avatar          string          `json:"avatar"`
-	BackgroundImage string          `json:"backgroundImage"`
-	Token           string          `json:"-"`
-	Connection      *websocket.Conn `json:"-"`
+	Id              UserId  `json:"id"`
+	Username        string  `json:"username"`
+	Name            string  `json:"name"`
+	Avatar          string  `json:"avatar"`
+	BackgroundImage string  `json:"backgroundImage"`
+	Presence        string  `json:"presence"`
+	Token           string  `json:"-"`
+	Connection      *Client `json:"-"`
+
+	joinedAt     time.Time
+	offlineSince time.Time
 }
@@ -3,6 +3,8 @@ package utils
 import (
 	"log"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -21,6 +23,20 @@ type Config struct {
 
 	RunnerURL    string
 	RunnerApiKey string
+	// RunnerTimings tells whether the runner reports the time of each test,
+	// the modes ranking by time need it.
+	RunnerTimings bool
+
+	PresenceGracePeriod time.Duration
+	// Countdown is the time between the start request and the first round.
+	Countdown     time.Duration
+	ResultsWindow time.Duration
+	// Intermission is the pause between the rounds of a match.
+	Intermission    time.Duration
+	ShutdownTimeout time.Duration
+
+	// MaxCodeSize is the largest code in bytes a lobby can accept.
+	MaxCodeSize int
 }
 
 func LoadConfig() *Config {
@@ -43,8 +59,17 @@ func LoadConfig() *Config {
 		BackendURL:    GetEnv("BACKEND_URL", "http://localhost:5000"),
 		BackendApiKey: GetEnv("BACKEND_API_KEY", "xxx"),
 
-		RunnerURL:    GetEnv("RUNNER_URL", "http://localhost:5020"),
-		RunnerApiKey: GetEnv("RUNNER_API_KEY", "xxx"),
+		RunnerURL:     GetEnv("RUNNER_URL", "http://localhost:5020"),
+		RunnerApiKey:  GetEnv("RUNNER_API_KEY", "xxx"),
+		RunnerTimings: GetEnv("RUNNER_TIMINGS", "false") == "true",
+
+		PresenceGracePeriod: GetEnvDuration("PRESENCE_GRACE_PERIOD", 30*time.Second),
+		Countdown:           GetEnvDuration("COUNTDOWN", 5*time.Second),
+		ResultsWindow:       GetEnvDuration("RESULTS_WINDOW", 5*time.Minute),
+		Intermission:        GetEnvDuration("INTERMISSION", 15*time.Second),
+		ShutdownTimeout:     GetEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+
+		MaxCodeSize: GetEnvInt("MAX_CODE_SIZE", 64*1024),
 	}
 }
 
@@ -57,3 +82,25 @@ func GetEnv(key string, defaultValue string) string {
 
 	return value
 }
+
+func GetEnvInt(key string, defaultValue int) int {
+	value := GetEnv(key, strconv.Itoa(defaultValue))
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("[WARN] Environment variable %s is not a valid integer, using default value %d\n", key, defaultValue)
+		return defaultValue
+	}
+
+	return number
+}
+
+func GetEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := GetEnv(key, defaultValue.String())
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("[WARN] Environment variable %s is not a valid duration, using default value %s\n", key, defaultValue)
+		return defaultValue
+	}
+
+	return duration
+}
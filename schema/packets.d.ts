@@ -0,0 +1,442 @@
+// Code generated by go generate; DO NOT EDIT.
+
+export interface EliminationSettings {
+  schedule?: number[];
+}
+
+export interface GolfSettings {
+  unit?: string;
+  stripWhitespace?: boolean;
+  stripComments?: boolean;
+}
+
+export interface PacketInBalanceTeams {
+  type: "balanceTeams";
+  requestId?: string;
+}
+
+export interface PacketInCheck {
+  type: "check";
+  code?: string;
+  language?: string;
+  requestId?: string;
+}
+
+export interface PacketInDelete {
+  type: "delete";
+  delete?: boolean;
+  requestId?: string;
+}
+
+export interface PacketInJoinTeam {
+  type: "joinTeam";
+  team?: number;
+  requestId?: string;
+}
+
+export interface PacketInKick {
+  type: "kick";
+  userId?: number;
+  requestId?: string;
+}
+
+export interface PacketInLock {
+  type: "lock";
+  lock?: boolean;
+  requestId?: string;
+}
+
+export interface PacketInReady {
+  type: "ready";
+  ready?: boolean;
+  requestId?: string;
+}
+
+export interface PacketInResync {
+  type: "resync";
+  requestId?: string;
+}
+
+export interface PacketInSetInvites {
+  type: "setInvites";
+  inviteOnly?: boolean;
+  userIds?: number[];
+  requestId?: string;
+}
+
+export interface PacketInSetPassword {
+  type: "setPassword";
+  password?: string;
+  requestId?: string;
+}
+
+export interface PacketInSettings {
+  type: "updateSettings";
+  settings?: Settings;
+  requestId?: string;
+}
+
+export interface PacketInStartLobby {
+  type: "start";
+  start?: boolean;
+  requestId?: string;
+}
+
+export interface PacketInSubmit {
+  type: "submit";
+  code?: string;
+  language?: string;
+  requestId?: string;
+}
+
+export interface PacketInTimeSync {
+  type: "timeSync";
+  clientTime?: number;
+  requestId?: string;
+}
+
+export interface PacketInTransferOwnership {
+  type: "transferOwnership";
+  userId?: number;
+  requestId?: string;
+}
+
+export interface PacketInUserStatus {
+  type: "updatePlayerStatus";
+  status?: string;
+  requestId?: string;
+}
+
+export interface RoundSettings {
+  count?: number;
+  bestOf?: boolean;
+}
+
+export interface Settings {
+  mode?: string;
+  maxPlayers?: number;
+  gameDuration?: number;
+  allowedLanguages?: string[];
+  maxCodeSize?: number;
+  golf?: GolfSettings;
+  teams?: TeamSettings;
+  rounds?: RoundSettings;
+  elimination?: EliminationSettings;
+}
+
+export interface TeamSettings {
+  count?: number;
+  scoring?: string;
+}
+
+export type InboundPacket = PacketInSettings | PacketInUserStatus | PacketInStartLobby | PacketInCheck | PacketInSubmit | PacketInLock | PacketInSetPassword | PacketInSetInvites | PacketInJoinTeam | PacketInBalanceTeams | PacketInDelete | PacketInReady | PacketInKick | PacketInTransferOwnership | PacketInResync | PacketInTimeSync;
+
+export interface Challenge {
+  id: number;
+  owner: {
+    id: number;
+    name: string;
+    username: string;
+    avatar: string;
+  };
+  title: string;
+  description: string;
+  content: string;
+  testCases: TestCase[];
+  hiddenTestCases: TestCase[];
+  created_at: string;
+  updated_at: string;
+}
+
+export interface ClosedLobbyState {
+  type: string;
+}
+
+export interface CountdownLobbyState {
+  type: string;
+  startTime: string;
+}
+
+export interface ExecutionResult {
+  output: string;
+  errors: string;
+  status: number;
+  wallTime: number | null;
+  cpuTime: number | null;
+}
+
+export interface GameLobbyState {
+  type: string;
+  round: number;
+  rounds: number;
+  gameId: string;
+  challenge: Challenge;
+  startTime: string;
+  deadline: string;
+  usersState: Record<string, UserGameLobbyState>;
+  submitCount: number;
+  eliminated?: Record<string, number>;
+}
+
+export interface IntermissionLobbyState {
+  type: string;
+  round: number;
+  rounds: number;
+  leaderboard: LeaderboardEntry[];
+  teams?: TeamEntry[];
+  scoreboard: ScoreboardEntry[];
+  nextRoundAt: string;
+}
+
+export interface LeaderboardEntry {
+  rank: number;
+  user: User | null;
+  submitted: boolean;
+  passedTests: number;
+  score?: number | null;
+  team?: number;
+  language?: string;
+  submittedAfter: number | null;
+}
+
+export interface LobbyAccess {
+  locked: boolean;
+  hasPassword: boolean;
+  inviteOnly: boolean;
+  invited: number[];
+}
+
+export interface PacketOutAccessUpdated {
+  type: "accessUpdated";
+  access: LobbyAccess;
+  seq: number;
+}
+
+export interface PacketOutCheckResult {
+  type: "checkResult";
+  requestId?: string;
+  error: string | null;
+  result: ExecutionResult[];
+  seq: number;
+}
+
+export interface PacketOutCountdown {
+  type: "countdown";
+  startTime: string;
+  seq: number;
+}
+
+export interface PacketOutError {
+  type: "error";
+  requestId?: string;
+  code: string;
+  message: string;
+  packetType: string;
+  seq: number;
+}
+
+export interface PacketOutGameEnded {
+  type: "gameEnded";
+  leaderboard: LeaderboardEntry[];
+  teams?: TeamEntry[];
+  scoreboard?: ScoreboardEntry[];
+  closesAt: string;
+  seq: number;
+}
+
+export interface PacketOutGameStarted {
+  type: "gameStarted";
+  round: number;
+  rounds: number;
+  startTime: string;
+  deadline: string;
+  challenge: Challenge;
+  seq: number;
+}
+
+export interface PacketOutLeaderboard {
+  type: "leaderboard";
+  leaderboard: LeaderboardEntry[];
+  seq: number;
+}
+
+export interface PacketOutLobby {
+  type: "lobby";
+  requestId?: string;
+  version: number;
+  id: string;
+  settings: Settings;
+  access: LobbyAccess;
+  owner: User | null;
+  users: Record<string, User | null>;
+  teams: Record<string, number>;
+  state: PreLobbyState | CountdownLobbyState | GameLobbyState | IntermissionLobbyState | ResultsLobbyState | ClosedLobbyState;
+  runs?: UserRuns | null;
+  seq: number;
+}
+
+export interface PacketOutLobbyDelete {
+  type: "lobbyDelete";
+  deleted: boolean;
+  seq: number;
+}
+
+export interface PacketOutLobbyPatch {
+  type: "lobbyPatch";
+  base: number;
+  version: number;
+  patch: PatchOperation[];
+  seq: number;
+}
+
+export interface PacketOutOwnerChanged {
+  type: "ownerChanged";
+  owner: User | null;
+  seq: number;
+}
+
+export interface PacketOutPlayersEliminated {
+  type: "playersEliminated";
+  round: number;
+  eliminated: number[];
+  remaining: number[];
+  seq: number;
+}
+
+export interface PacketOutPresence {
+  type: "presence";
+  userId: number;
+  presence: string;
+  seq: number;
+}
+
+export interface PacketOutRoundEnded {
+  type: "roundEnded";
+  round: number;
+  leaderboard: LeaderboardEntry[];
+  teams?: TeamEntry[];
+  scoreboard: ScoreboardEntry[];
+  nextRoundAt: string;
+  seq: number;
+}
+
+export interface PacketOutSettingsUpdated {
+  type: "settingsUpdated";
+  settings: Settings;
+  seq: number;
+}
+
+export interface PacketOutSubmitResult {
+  type: "submitResult";
+  requestId?: string;
+  error: string | null;
+  result: ExecutionResult[];
+  seq: number;
+}
+
+export interface PacketOutTeamsUpdated {
+  type: "teamsUpdated";
+  teams: Record<string, number>;
+  seq: number;
+}
+
+export interface PacketOutTimeSync {
+  type: "timeSync";
+  requestId?: string;
+  clientTime: number;
+  serverReceiveTime: number;
+  serverSendTime: number;
+  seq: number;
+}
+
+export interface PacketOutTimer {
+  type: "timer";
+  phase: string;
+  deadline: string;
+  remaining: number;
+  serverTime: number;
+  seq: number;
+}
+
+export interface PacketOutUsersUpdate {
+  type: "usersUpdate";
+  users: Record<string, User | null>;
+  readyUsers: number[];
+  seq: number;
+}
+
+export interface PatchOperation {
+  op: string;
+  path: string;
+  value: unknown;
+}
+
+export interface PreLobbyState {
+  type: string;
+  ready: number[];
+}
+
+export interface ResultsLobbyState {
+  type: string;
+  game: GameLobbyState | null;
+  leaderboard: LeaderboardEntry[];
+  teams?: TeamEntry[];
+  scoreboard?: ScoreboardEntry[];
+  closesAt: string;
+}
+
+export interface RunResult {
+  code: string;
+  language: string;
+  results: ExecutionResult[];
+  passedTests: number;
+  score?: number | null;
+  wallTime: number;
+  cpuTime: number;
+  runs: number;
+  date: string;
+}
+
+export interface ScoreboardEntry {
+  rank: number;
+  user: User | null;
+  team?: number;
+  points: number;
+  wins: number;
+  eliminatedIn?: number;
+}
+
+export interface TeamEntry {
+  rank: number;
+  team: number;
+  members: number[];
+  score: number;
+  submittedAfter: number | null;
+}
+
+export interface TestCase {
+  input: string;
+  output: string;
+}
+
+export interface User {
+  id: number;
+  username: string;
+  name: string;
+  avatar: string;
+  backgroundImage: string;
+  presence: string;
+}
+
+export interface UserGameLobbyState {
+  submitted: boolean;
+  passedTests: number;
+  score?: number | null;
+}
+
+export interface UserRuns {
+  lastRunResult: RunResult | null;
+  submitResult: RunResult | null;
+}
+
+export type OutboundPacket = PacketOutLobby | PacketOutGameStarted | PacketOutCheckResult | PacketOutSubmitResult | PacketOutUsersUpdate | PacketOutLobbyDelete | PacketOutPresence | PacketOutOwnerChanged | PacketOutCountdown | PacketOutGameEnded | PacketOutError | PacketOutLobbyPatch | PacketOutTimeSync | PacketOutTimer | PacketOutSettingsUpdated | PacketOutAccessUpdated | PacketOutLeaderboard | PacketOutTeamsUpdated | PacketOutRoundEnded | PacketOutPlayersEliminated;